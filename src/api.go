@@ -1,27 +1,57 @@
 package main
 
 import (
+	"container/list"
 	"context"
 	"crypto/tls"
+	"expvar"
 	"fmt"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/futurice/alley-oop/src/autocert"
 	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Wait for the echo of a probed address at most this long
+	probeTimeout = 5 * time.Second
+	// Each client may probe once in this interval
+	probeInterval = 10 * time.Second
+	// Bound the memory used by the clients probing
+	maxProbeClients = 10000
 )
 
 type API struct {
-	Handler http.Handler
-	db      Database
-	certmgr autocert.Manager
+	Handler   http.Handler
+	db        Database
+	certmgr   *autocert.Manager
+	chainOnly bool
+	zones     []dnsConfig
+	views     map[string]bool
+	health    *healthChecker
+
+	probeMu    sync.Mutex
+	probes     map[string]*list.Element // by client address, into probeOrder
+	probeOrder *list.List               // last probe of every client, the oldest first
+}
+
+// clientProbe is the last probe of a client
+type clientProbe struct {
+	client string
+	at     time.Time
 }
 
 var (
 	hostnameRegexp = regexp.MustCompile("^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\\-]*[a-zA-Z0-9])\\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\\-]*[A-Za-z0-9])$")
+	// Names of records may have labels with underscores, e.g. for SRV records
+	recordnameRegexp = regexp.MustCompile("^(([a-zA-Z0-9_]|[a-zA-Z0-9_][a-zA-Z0-9_\\-]*[a-zA-Z0-9_])\\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\\-]*[A-Za-z0-9])$")
 )
 
 func flattenParams(params []string) []string {
@@ -71,6 +101,7 @@ func (api *API) v1update(w http.ResponseWriter, req *http.Request, _ httprouter.
 		hostnames []string
 		myips     []string
 		ips       []net.IP
+		view      string
 	)
 
 	w.Header().Set("Cache-Control", "no-store, must-revalidate")
@@ -94,6 +125,12 @@ func (api *API) v1update(w http.ResponseWriter, req *http.Request, _ httprouter.
 		return
 	}
 
+	// Addresses for clients in a view only, as set up in the configuration
+	view = req.Form.Get("view")
+	if view != "" && !api.views[view] {
+		goto BadRequest
+	}
+
 	myips = flattenParams(req.Form["myip"])
 	if myips == nil {
 		goto BadRequest
@@ -120,13 +157,30 @@ func (api *API) v1update(w http.ResponseWriter, req *http.Request, _ httprouter.
 		}
 
 		domain := strings.ToLower(hostname)
-		origips, err := api.db.GetIPAddresses(ctx, domain)
+		if _, ok := getZoneConfig(domain, api.zones); !ok {
+			fmt.Fprintf(w, "nohost")
+			continue
+		}
+		if err := checkCNAME(ctx, api.db, domain, dns.TypeA, nil, nil); err != nil {
+			fmt.Fprintf(w, "dnserr")
+			continue
+		}
+		var origips []net.IP
+		if view != "" {
+			origips, err = api.db.GetViewAddresses(ctx, domain, view)
+		} else {
+			origips, err = api.db.GetIPAddresses(ctx, domain)
+		}
 		if err == nil && !haveAddressesChanged(origips, ips) {
 			fmt.Fprintf(w, "nochg ")
 		} else {
 			fmt.Fprintf(w, "good ")
 		}
-		err = api.db.PutIPAddresses(ctx, domain, ips)
+		if view != "" {
+			err = api.db.PutViewAddresses(ctx, domain, view, ips)
+		} else {
+			err = api.db.PutIPAddresses(ctx, domain, ips)
+		}
 		if err != nil {
 			fmt.Fprintf(w, "dnserr")
 			continue
@@ -136,7 +190,7 @@ func (api *API) v1update(w http.ResponseWriter, req *http.Request, _ httprouter.
 			if idx != 0 {
 				fmt.Fprintf(w, ",")
 			}
-			fmt.Fprintf(w, ip.String())
+			fmt.Fprint(w, ip.String())
 		}
 	}
 	return
@@ -181,7 +235,7 @@ func (api *API) v1privatekey(w http.ResponseWriter, req *http.Request, _ httprou
 
 	w.Header().Set("Content-Type", "application/x-pem-file")
 	w.Header().Set("Cache-Control", "no-store, must-revalidate")
-	fmt.Fprintf(w, key)
+	fmt.Fprint(w, key)
 }
 
 func (api *API) v1certificate(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -210,7 +264,7 @@ func (api *API) v1certificate(w http.ResponseWriter, req *http.Request, _ httpro
 		return
 	}
 
-	certs, err := getCertificates(cert)
+	certs, err := getCertificates(cert, api.chainOnly)
 	if err != nil {
 		newErr := fmt.Errorf("getCertificates failed with error: %v", err)
 		http.Error(w,newErr.Error(), http.StatusInternalServerError)
@@ -219,7 +273,285 @@ func (api *API) v1certificate(w http.ResponseWriter, req *http.Request, _ httpro
 
 	w.Header().Set("Content-Type", "application/x-pem-file")
 	w.Header().Set("Cache-Control", "no-store, must-revalidate")
-	fmt.Fprintf(w, certs)
+	fmt.Fprint(w, certs)
+}
+
+func (api *API) v1ocsp(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, "parse error", http.StatusInternalServerError)
+		return
+	}
+
+	hostnames := req.Form["hostname"]
+	if len(hostnames) != 1 {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	hostname := hostnames[0]
+	if !hostnameRegexp.MatchString(hostname) {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: hostname}
+	cert, err := api.certmgr.GetCertificate(hello)
+	if err != nil {
+		newErr := fmt.Errorf("GetCertificate failed with error: %v", err)
+		http.Error(w, newErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The staple is fetched in the background, there may be none yet
+	if len(cert.OCSPStaple) == 0 {
+		http.Error(w, "no OCSP response available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Header().Set("Cache-Control", "no-store, must-revalidate")
+	w.Write(cert.OCSPStaple)
+}
+
+// v1health lists the addresses of a host with their health, "unknown" if
+// they aren't probed
+func (api *API) v1health(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, "parse error", http.StatusBadRequest)
+		return
+	}
+
+	hostnames := req.Form["hostname"]
+	if len(hostnames) != 1 || !hostnameRegexp.MatchString(hostnames[0]) {
+		http.Error(w, "param error", http.StatusBadRequest)
+		return
+	}
+	domain := strings.ToLower(hostnames[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ipaddrs, err := api.db.GetIPAddresses(ctx, domain)
+	if err != nil {
+		http.Error(w, "dnserr", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store, must-revalidate")
+	for _, ip := range ipaddrs {
+		var healthy, known bool
+		if api.health != nil {
+			healthy, known = api.health.get(domain, ip)
+		}
+		fmt.Fprintf(w, "%s %s\n", ip, getHealthString(healthy, known))
+	}
+}
+
+// allowProbe tells whether client may probe now, and if so, records it
+func (api *API) allowProbe(client net.IP, now time.Time) bool {
+	api.probeMu.Lock()
+	defer api.probeMu.Unlock()
+	if api.probes == nil {
+		api.probes = make(map[string]*list.Element)
+		api.probeOrder = list.New()
+	}
+	key := client.String()
+	if e, ok := api.probes[key]; ok {
+		last := e.Value.(*clientProbe)
+		if now.Sub(last.at) < probeInterval {
+			return false
+		}
+		last.at = now
+		api.probeOrder.MoveToBack(e)
+		return true
+	}
+	if api.probeOrder.Len() >= maxProbeClients {
+		// Forget the client which probed the longest ago
+		oldest := api.probeOrder.Front()
+		api.probeOrder.Remove(oldest)
+		delete(api.probes, oldest.Value.(*clientProbe).client)
+	}
+	api.probes[key] = api.probeOrder.PushBack(&clientProbe{client: key, at: now})
+	return true
+}
+
+// isProbeAllowed tells whether client may probe ip. Addresses which only
+// make sense inside the network of the server are left alone, so that the
+// server can't be used to reach its own services.
+func isProbeAllowed(ip, client net.IP) bool {
+	if ip.Equal(client) {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsPrivate() &&
+		!ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// v1probe checks that the client, or every address of a host, echoes a nonce
+// sent to a TCP port, e.g. to verify the port forwarding of a NAT. Loopback,
+// link-local and private addresses other than that of the client are not
+// probed, and each client may probe once every probeInterval.
+func (api *API) v1probe(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, "parse error", http.StatusBadRequest)
+		return
+	}
+
+	port, err := strconv.Atoi(req.Form.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(w, "param error", http.StatusBadRequest)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	client := net.ParseIP(host)
+	if err != nil || client == nil {
+		http.Error(w, "no client address", http.StatusBadRequest)
+		return
+	}
+
+	var ipaddrs []net.IP
+	hostnames := req.Form["hostname"]
+	switch {
+	case len(hostnames) == 0:
+		ipaddrs = []net.IP{client}
+	case len(hostnames) == 1 && hostnameRegexp.MatchString(hostnames[0]):
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ipaddrs, err = api.db.GetIPAddresses(ctx, strings.ToLower(hostnames[0]))
+		cancel()
+		if err != nil {
+			http.Error(w, "dnserr", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "param error", http.StatusBadRequest)
+		return
+	}
+
+	if !api.allowProbe(client, time.Now()) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	results := make([]bool, len(ipaddrs))
+	var wg sync.WaitGroup
+	for idx, ip := range ipaddrs {
+		if !isProbeAllowed(ip, client) {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, ip net.IP) {
+			defer wg.Done()
+			results[idx] = testTCPEcho("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), probeTimeout)
+		}(idx, ip)
+	}
+	wg.Wait()
+
+	w.Header().Set("Cache-Control", "no-store, must-revalidate")
+	for idx, ip := range ipaddrs {
+		result := "fail"
+		if !isProbeAllowed(ip, client) {
+			result = "refused"
+		} else if results[idx] {
+			result = "good"
+		}
+		fmt.Fprintf(w, "%s %s\n", ip, result)
+	}
+}
+
+// v1records returns (GET), replaces (PUT) or deletes (DELETE) the records
+// of one type at a name, e.g. the SRV records of _mqtt._tcp.example.org
+func (api *API) v1records(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-store, must-revalidate")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, "parse error", http.StatusBadRequest)
+		return
+	}
+
+	hostnames := req.Form["hostname"]
+	types := req.Form["type"]
+	if len(hostnames) != 1 || len(types) != 1 {
+		http.Error(w, "param error", http.StatusBadRequest)
+		return
+	}
+
+	hostname := hostnames[0]
+	if !recordnameRegexp.MatchString(hostname) {
+		http.Error(w, "regexp error", http.StatusBadRequest)
+		return
+	}
+	domain := strings.ToLower(hostname)
+	if _, ok := getZoneConfig(domain, api.zones); !ok {
+		http.Error(w, "zone error", http.StatusBadRequest)
+		return
+	}
+
+	rrtype := dns.StringToType[strings.ToUpper(types[0])]
+	if !isRecordType(rrtype) {
+		http.Error(w, "unsupported record type", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		values, err := api.db.GetRecords(ctx, domain, rrtype)
+		if err != nil {
+			newErr := fmt.Errorf("GetRecords failed with error: %v", err)
+			http.Error(w, newErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, value := range values {
+			fmt.Fprintf(w, "%s\n", value)
+		}
+
+	case http.MethodPut:
+		var values []string
+		for _, value := range req.Form["value"] {
+			value, err := getRecordValue(rrtype, value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			http.Error(w, "param error", http.StatusBadRequest)
+			return
+		}
+		if rrtype == dns.TypeCNAME && isZoneApex(domain, api.zones) {
+			http.Error(w, "zone apex can't have a CNAME record", http.StatusConflict)
+			return
+		}
+		if err := checkCNAME(ctx, api.db, domain, rrtype, values, api.getViewNames()); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := api.db.PutRecords(ctx, domain, rrtype, values); err != nil {
+			newErr := fmt.Errorf("PutRecords failed with error: %v", err)
+			http.Error(w, newErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "good\n")
+
+	case http.MethodDelete:
+		if err := api.db.DeleteRecords(ctx, domain, rrtype); err != nil {
+			newErr := fmt.Errorf("DeleteRecords failed with error: %v", err)
+			http.Error(w, newErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "good\n")
+	}
+}
+
+func (api *API) v1stats(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-store, must-revalidate")
+	expvar.Handler().ServeHTTP(w, req)
 }
 
 type dbTxtHandler struct {
@@ -227,6 +559,10 @@ type dbTxtHandler struct {
 }
 
 func (db dbTxtHandler) PutTXTRecord(ctx context.Context, domain string, value string) {
+	if err := checkCNAME(ctx, db, domain, dns.TypeTXT, nil, nil); err != nil {
+		fmt.Printf("PutTXTValues failed with error: %v", err)
+		return
+	}
 	if err := db.PutTXTValues(ctx, domain, []string{value}); err != nil {
 		// FIXME: Handle error
 		fmt.Printf("PutTXTValues failed with error: %v", err)
@@ -260,6 +596,10 @@ func (db dbCertCache) Delete(ctx context.Context, name string) error {
 	return db.DeleteCertificate(ctx, name)
 }
 
+func (db dbCertCache) List(ctx context.Context) ([]string, error) {
+	return db.ListCertificates(ctx)
+}
+
 func BasicAuth(h httprouter.Handle, requiredUser, requiredPassword string) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		// Get the Basic Authentication credentials
@@ -276,25 +616,144 @@ func BasicAuth(h httprouter.Handle, requiredUser, requiredPassword string) httpr
 	}
 }
 
-func NewAPI(auth authConfig, db Database) *API {
+// ZoneBasicAuth is like BasicAuth, but also accepts the credentials of a
+// zone, if every hostname of the request is in that zone
+func ZoneBasicAuth(h httprouter.Handle, auth authConfig, zones []dnsConfig) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, password, hasAuth := r.BasicAuth()
+		if hasAuth && user == auth.Username && password == auth.Password {
+			h(w, r, ps)
+			return
+		}
+
+		if hasAuth && r.ParseForm() == nil {
+			for _, zone := range zones {
+				if zone.Auth.Username == "" || user != zone.Auth.Username || password != zone.Auth.Password {
+					continue
+				}
+				if isInZone(flattenParams(r.Form["hostname"]), getDomain(zone.Domain), zones) {
+					h(w, r, ps)
+					return
+				}
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// ZoneNetworks refuses requests from clients outside the allowed networks of
+// the zone of any hostname of the request
+func ZoneNetworks(h httprouter.Handle, zones []dnsConfig) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if r.ParseForm() == nil {
+			for _, hostname := range flattenParams(r.Form["hostname"]) {
+				zone, ok := getZoneConfig(getDomain(hostname), zones)
+				if ok && !isNetworkAllowed(ip, zone) {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+// isInZone tells whether hostnames are all in zone, and not in another zone
+// below it
+func isInZone(hostnames []string, zone string, zones []dnsConfig) bool {
+	isZone := func(name string) bool {
+		return isZoneApex(name, zones)
+	}
+	for _, hostname := range hostnames {
+		name, ok := getZone(getDomain(hostname), isZone)
+		if !ok || name != zone {
+			return false
+		}
+	}
+	return len(hostnames) > 0
+}
+
+// isZoneApex tells whether domain is the apex of one of zones
+func isZoneApex(domain string, zones []dnsConfig) bool {
+	for _, zone := range zones {
+		if getDomain(zone.Domain) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// getViewNames returns the names of the configured views
+func (api *API) getViewNames() []string {
+	var names []string
+	for name := range api.views {
+		names = append(names, name)
+	}
+	return names
+}
+
+func getIssuanceBudget(cert certConfig) *autocert.IssuanceBudget {
+	if cert.MaxCertificates == 0 && cert.MaxOrders == 0 {
+		return nil
+	}
+	return &autocert.IssuanceBudget{
+		Certificates:   autocert.RateLimit{Limit: cert.MaxCertificates, Window: 7 * 24 * time.Hour},
+		Orders:         autocert.RateLimit{Limit: cert.MaxOrders, Window: 3 * time.Hour},
+		RenewalReserve: cert.RenewalReserve,
+	}
+}
+
+func NewAPI(auth authConfig, cert certConfig, db Database, zones []dnsConfig, views []viewConfig, health *healthChecker) *API {
 	authWrapper := func(h httprouter.Handle) httprouter.Handle {
-		return BasicAuth(h, auth.Username, auth.Password)
+		return ZoneBasicAuth(h, auth, zones)
 	}
 
-	api := &API{db: db}
+	api := &API{db: db, chainOnly: cert.Output == "chain", zones: zones, views: make(map[string]bool), health: health}
+	for _, view := range views {
+		api.views[view.Name] = true
+	}
 	router := httprouter.New()
 	router.GET("/", api.index)
-	router.GET("/v1/update", authWrapper(api.v1update))
+	router.GET("/v1/update", authWrapper(ZoneNetworks(api.v1update, zones)))
 	router.GET("/v1/privatekey", authWrapper(api.v1privatekey))
 	router.GET("/v1/certificate", authWrapper(api.v1certificate))
+	router.GET("/v1/ocsp", authWrapper(api.v1ocsp))
+	router.GET("/v1/records", authWrapper(ZoneNetworks(api.v1records, zones)))
+	router.PUT("/v1/records", authWrapper(ZoneNetworks(api.v1records, zones)))
+	router.DELETE("/v1/records", authWrapper(ZoneNetworks(api.v1records, zones)))
+	router.GET("/v1/stats", authWrapper(api.v1stats))
+	router.GET("/v1/health", authWrapper(api.v1health))
+	router.GET("/v1/probe", authWrapper(api.v1probe))
 	api.Handler = router
 
-	manager := autocert.Manager{
-		Cache:  dbCertCache{db},
-		Prompt: autocert.AcceptTOS,
+	manager := &autocert.Manager{
+		Cache:     dbCertCache{db},
+		Prompt:    autocert.AcceptTOS,
+		RenewIdle: time.Duration(cert.RenewIdleDays) * 24 * time.Hour,
+		Budget:    getIssuanceBudget(cert),
+
+		PreferredChain: cert.PreferredChain,
+		Profile:        cert.Profile,
+	}
+	if cert.MustStaple {
+		manager.ExtraExtensions = append(manager.ExtraExtensions, autocert.MustStapleExtension)
 	}
 	manager.DNSHandler(dbTxtHandler{db})
 	api.certmgr = manager
 
 	return api
 }
+
+// RenewCachedCertificates starts renewal timers for every certificate in
+// the database, so that certificates not fetched after a restart don't expire.
+func (api *API) RenewCachedCertificates() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := api.certmgr.RenewCached(ctx); err != nil {
+		fmt.Printf("RenewCached failed with error: %v\n", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIsProbeAllowed(t *testing.T) {
+	client := net.ParseIP("198.51.100.1")
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"198.51.100.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if allowed := isProbeAllowed(net.ParseIP(tt.ip), client); allowed != tt.allowed {
+			t.Errorf("isProbeAllowed(%s) = %v; want %v", tt.ip, allowed, tt.allowed)
+		}
+	}
+	// The client may probe itself behind a NAT of its own
+	if !isProbeAllowed(net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.1")) {
+		t.Error("client not allowed to probe its own private address")
+	}
+}
+
+func TestAllowProbe(t *testing.T) {
+	api := &API{}
+	now := time.Now()
+	a, b := net.ParseIP("198.51.100.1"), net.ParseIP("198.51.100.2")
+	tests := []struct {
+		name    string
+		client  net.IP
+		at      time.Duration
+		allowed bool
+	}{
+		{"first", a, 0, true},
+		{"again", a, time.Second, false},
+		{"other client", b, time.Second, true},
+		{"after the interval", a, probeInterval, true},
+		{"again after the interval", a, probeInterval + time.Second, false},
+	}
+	for _, tt := range tests {
+		if allowed := api.allowProbe(tt.client, now.Add(tt.at)); allowed != tt.allowed {
+			t.Errorf("%s: allowProbe = %v; want %v", tt.name, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestAllowProbeLimit(t *testing.T) {
+	api := &API{}
+	now := time.Now()
+	client := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+	for i := 0; i < maxProbeClients; i++ {
+		api.allowProbe(client(i), now.Add(time.Duration(i)*time.Microsecond))
+	}
+	// The first client probes again, so the second is the oldest
+	later := now.Add(probeInterval)
+	if !api.allowProbe(client(0), later) {
+		t.Fatal("first client not allowed to probe after the interval")
+	}
+	if !api.allowProbe(client(maxProbeClients), later) {
+		t.Fatal("new client not allowed to probe with the table full")
+	}
+	if len(api.probes) != maxProbeClients || api.probeOrder.Len() != maxProbeClients {
+		t.Errorf("%d clients tracked; want %d", len(api.probes), maxProbeClients)
+	}
+	if _, ok := api.probes[client(1).String()]; ok {
+		t.Error("oldest client not forgotten")
+	}
+	// The others are still remembered, within the interval
+	for _, i := range []int{0, 2, maxProbeClients - 1, maxProbeClients} {
+		if api.allowProbe(client(i), later) {
+			t.Errorf("client %s allowed to probe again", client(i))
+		}
+	}
+}
+
+func TestV1Probe(t *testing.T) {
+	// Echo the first line of every connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	db := &MemoryDatabase{}
+	if err := db.PutIPAddresses(context.Background(), "a.example.org", []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	api := &API{db: db}
+	tests := []struct {
+		name   string
+		remote string
+		query  string
+		code   int
+		body   string
+	}{
+		{"client", "127.0.0.1:1234", "port=" + port, http.StatusOK, "127.0.0.1 good\n"},
+		{"too soon", "127.0.0.1:1234", "port=" + port, http.StatusTooManyRequests, ""},
+		{"private address of a host", "198.51.100.1:1234", "hostname=a.example.org&port=" + port, http.StatusOK,
+			"127.0.0.1 refused\n"},
+		{"bad port", "198.51.100.2:1234", "port=65536", http.StatusBadRequest, ""},
+		{"bad hostname", "198.51.100.2:1234", "hostname=-&port=" + port, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/probe?"+tt.query, nil)
+		r.RemoteAddr = tt.remote
+		api.v1probe(w, r, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d; want %d", tt.name, w.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && w.Body.String() != tt.body {
+			t.Errorf("%s: body = %q; want %q", tt.name, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestV1OCSPParseError(t *testing.T) {
+	api := &API{db: &MemoryDatabase{}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/ocsp?hostname=%zz", nil)
+	api.v1ocsp(w, r, nil)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "parse error\n" {
+		t.Errorf("status = %d, body = %q; want %d, %q", w.Code, w.Body.String(), http.StatusInternalServerError,
+			"parse error\n")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ACME Renewal Information (ARI), RFC 9773.
+
+const (
+	// ariDefaultRetry is how often renewal information is polled
+	// when the CA does not send a Retry-After header.
+	ariDefaultRetry = 6 * time.Hour
+	// ariMinRetry and ariMaxRetry bound the polling interval
+	// regardless of what the CA asks for.
+	ariMinRetry = time.Hour
+	ariMaxRetry = 24 * time.Hour
+)
+
+// errNoRenewalInfo is returned when the CA does not offer renewal information
+// for a certificate, in which case the regular renewal schedule applies.
+var errNoRenewalInfo = errors.New("acme/autocert: no renewal information available")
+
+// directoryExt holds the fields of the CA's directory
+// which acme.Directory does not expose.
+type directoryExt struct {
+	RenewalInfo string `json:"renewalInfo"`
+	Meta        struct {
+		// Profiles maps the names of the certificate profiles
+		// offered by the CA to their descriptions.
+		Profiles map[string]string `json:"profiles"`
+	} `json:"meta"`
+}
+
+// directoryExt fetches the CA's directory and caches the result.
+// Unlike acme.Client.Discover, it requires no account.
+func (m *Manager) directoryExt(ctx context.Context) (*directoryExt, error) {
+	m.dirExtMu.Lock()
+	defer m.dirExtMu.Unlock()
+	if m.dirExt != nil {
+		return m.dirExt, nil
+	}
+
+	req, err := http.NewRequest("GET", m.directoryURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := m.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme/autocert: directory request returned %s", res.Status)
+	}
+	ext := &directoryExt{}
+	if err := json.NewDecoder(res.Body).Decode(ext); err != nil {
+		return nil, err
+	}
+	m.dirExt = ext
+	return ext, nil
+}
+
+// supportsARI reports whether the CA's directory, as far as it has
+// been fetched already, offers renewal information.
+func (m *Manager) supportsARI() bool {
+	m.dirExtMu.Lock()
+	defer m.dirExtMu.Unlock()
+	return m.dirExt != nil && m.dirExt.RenewalInfo != ""
+}
+
+// renewalInfo is the CA's suggestion of when to renew a certificate.
+type renewalInfo struct {
+	start, end time.Time
+	retryAfter time.Duration // when to ask again
+}
+
+// renewalInfo fetches the suggested renewal window of leaf from the CA.
+// It returns errNoRenewalInfo if the CA does not support ARI,
+// or if leaf cannot be identified to the CA.
+func (m *Manager) renewalInfo(ctx context.Context, leaf *x509.Certificate) (*renewalInfo, error) {
+	ext, err := m.directoryExt(ctx)
+	if err != nil || ext.RenewalInfo == "" {
+		return nil, errNoRenewalInfo
+	}
+	id, err := ariCertID(leaf)
+	if err != nil {
+		return nil, errNoRenewalInfo
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(ext.RenewalInfo, "/")+"/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := m.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme/autocert: renewal info request returned %s", res.Status)
+	}
+
+	var v struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	if !v.SuggestedWindow.End.After(v.SuggestedWindow.Start) {
+		return nil, errors.New("acme/autocert: invalid suggested renewal window")
+	}
+	return &renewalInfo{
+		start:      v.SuggestedWindow.Start,
+		end:        v.SuggestedWindow.End,
+		retryAfter: retryAfter(res.Header.Get("Retry-After"), m.now()),
+	}, nil
+}
+
+// retryAfter parses a Retry-After header value, either delay seconds
+// or an HTTP date, and clamps it to [ariMinRetry, ariMaxRetry].
+func retryAfter(v string, now time.Time) time.Duration {
+	d := ariDefaultRetry
+	if sec, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(sec) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d < ariMinRetry {
+		return ariMinRetry
+	}
+	if d > ariMaxRetry {
+		return ariMaxRetry
+	}
+	return d
+}
+
+// ariCertID returns the unique identifier of leaf used by ARI: the base64url
+// encoded key identifier of its issuer and its serial number, joined by a dot.
+func ariCertID(leaf *x509.Certificate) (string, error) {
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", errors.New("acme/autocert: certificate has no authority key identifier")
+	}
+	der, err := asn1.Marshal(leaf.SerialNumber)
+	if err != nil {
+		return "", err
+	}
+	// The serial number goes without the DER tag and length.
+	var serial asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &serial); err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(leaf.AuthorityKeyId) + "." + enc.EncodeToString(serial.Bytes), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestARICertID(t *testing.T) {
+	// Example from RFC 9773, section 4.1.
+	leaf := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3,
+			0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber: big.NewInt(0x87654321),
+	}
+	id, err := ariCertID(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; id != want {
+		t.Errorf("ariCertID = %q; want %q", id, want)
+	}
+
+	if _, err := ariCertID(&x509.Certificate{SerialNumber: big.NewInt(1)}); err == nil {
+		t.Error("ariCertID: want error for a cert without authority key id")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	tt := []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", ariDefaultRetry},
+		{"junk", ariDefaultRetry},
+		{"7200", 2 * time.Hour},
+		{"60", ariMinRetry},
+		{"604800", ariMaxRetry},
+		{now.Add(3 * time.Hour).UTC().Format(http.TimeFormat), 3 * time.Hour},
+	}
+	for _, test := range tt {
+		got := retryAfter(test.v, now)
+		// HTTP dates have a resolution of one second.
+		if d := got - test.want; d < -time.Second || d > time.Second {
+			t.Errorf("retryAfter(%q) = %v; want %v", test.v, got, test.want)
+		}
+	}
+}
+
+// startARIServerStub returns a CA stub serving a directory and,
+// if window is non-nil, renewal information with the given window.
+func startARIServerStub(t *testing.T, window func() (start, end time.Time)) *httptest.Server {
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/":
+			dir := map[string]string{"newNonce": ca.URL + "/nonce"}
+			if window != nil {
+				dir["renewalInfo"] = ca.URL + "/ari"
+			}
+			json.NewEncoder(w).Encode(dir)
+		case strings.HasPrefix(r.URL.Path, "/ari/") && window != nil:
+			start, end := window()
+			w.Header().Set("Retry-After", "7200")
+			fmt.Fprintf(w, `{"suggestedWindow": {"start": %q, "end": %q}}`,
+				start.Format(time.RFC3339), end.Format(time.RFC3339))
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	return ca
+}
+
+func ariTestLeaf() *x509.Certificate {
+	return &x509.Certificate{
+		AuthorityKeyId: []byte{1, 2, 3},
+		SerialNumber:   big.NewInt(42),
+		NotAfter:       time.Now().Add(90 * 24 * time.Hour),
+	}
+}
+
+func TestNextARI(t *testing.T) {
+	now := time.Now()
+	start, end := now.Add(10*time.Hour), now.Add(20*time.Hour)
+	ca := startARIServerStub(t, func() (time.Time, time.Time) { return start, end })
+	defer ca.Close()
+
+	man := &Manager{
+		Client:  &acme.Client{DirectoryURL: ca.URL},
+		nowFunc: func() time.Time { return now },
+	}
+	dr := &domainRenewal{m: man}
+	leaf := ariTestLeaf()
+
+	// The window is beyond Retry-After: poll again then.
+	next, ok := dr.nextARI(context.Background(), leaf)
+	if !ok {
+		t.Fatal("nextARI: renewal info not used")
+	}
+	if next != 2*time.Hour {
+		t.Errorf("nextARI = %v; want Retry-After of 2h", next)
+	}
+	if dr.ariAt.Before(start) || !dr.ariAt.Before(end) {
+		t.Errorf("renewal time %v not within [%v, %v)", dr.ariAt, start, end)
+	}
+	if !man.supportsARI() {
+		t.Error("supportsARI = false; want true")
+	}
+
+	// The same window keeps the chosen renewal time.
+	at := dr.ariAt
+	dr.nextARI(context.Background(), leaf)
+	if !dr.ariAt.Equal(at) {
+		t.Errorf("renewal time changed from %v to %v", at, dr.ariAt)
+	}
+
+	// A window in the past, as during a mass revocation, means right away.
+	start, end = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	next, ok = dr.nextARI(context.Background(), leaf)
+	if !ok || next != 0 {
+		t.Errorf("nextARI = %v, %v; want 0, true", next, ok)
+	}
+}
+
+func TestNextARIFallback(t *testing.T) {
+	ca := startARIServerStub(t, nil)
+	defer ca.Close()
+
+	man := &Manager{Client: &acme.Client{DirectoryURL: ca.URL}}
+	dr := &domainRenewal{m: man}
+	if _, ok := dr.nextARI(context.Background(), ariTestLeaf()); ok {
+		t.Error("nextARI: want fallback without renewalInfo endpoint")
+	}
+	if man.supportsARI() {
+		t.Error("supportsARI = true; want false")
+	}
+}
+
+func TestAuthorizeOrderReplaces(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"newNonce": %q, "newOrder": %q, "newAccount": %q}`,
+				ca.URL+"/nonce", ca.URL+"/new-order", ca.URL+"/new-account")
+		case "/nonce":
+		case "/new-order":
+			var jws struct{ Protected, Payload, Signature string }
+			if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+				t.Fatalf("new-order: %v", err)
+			}
+			enc := base64.RawURLEncoding
+			sig, _ := enc.DecodeString(jws.Signature)
+			digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+			rs, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], rs, ss) {
+				t.Error("new-order: invalid signature")
+			}
+			var head struct{ Alg, KID, Nonce, URL string }
+			b, _ := enc.DecodeString(jws.Protected)
+			json.Unmarshal(b, &head)
+			if head.Alg != "ES256" || head.KID != "https://ca/acct/1" || head.Nonce != "nonce" || head.URL != ca.URL+"/new-order" {
+				t.Errorf("new-order: protected header = %+v", head)
+			}
+			var req struct {
+				Identifiers []struct{ Type, Value string }
+				Replaces    string
+			}
+			b, _ = enc.DecodeString(jws.Payload)
+			json.Unmarshal(b, &req)
+			if req.Replaces != "AQID.Kg" || len(req.Identifiers) != 1 || req.Identifiers[0].Value != exampleDomain {
+				t.Errorf("new-order: payload = %s", b)
+			}
+			w.Header().Set("Location", ca.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"status": "pending", "authorizations": [%q], "finalize": %q}`,
+				ca.URL+"/authz/1", ca.URL+"/order/1/finalize")
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer ca.Close()
+
+	client := &acme.Client{DirectoryURL: ca.URL, Key: key, KID: "https://ca/acct/1"}
+	man := &Manager{Client: client}
+	id, err := ariCertID(ariTestLeaf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := man.authorizeOrder(context.Background(), client, exampleDomain, orderOptions{replaces: id})
+	if err != nil {
+		t.Fatalf("authorizeOrder: %v", err)
+	}
+	if o.URI != ca.URL+"/order/1" || o.Status != acme.StatusPending || o.FinalizeURL != ca.URL+"/order/1/finalize" || len(o.AuthzURLs) != 1 {
+		t.Errorf("order = %+v", o)
+	}
+}
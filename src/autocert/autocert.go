@@ -140,8 +140,27 @@ type Manager struct {
 	// be renewed before they expire.
 	//
 	// If zero, they're renewed 30 days before expiration.
+	// Either way, certificates are not renewed before only a third
+	// of their lifetime remains, so that short-lived ones last a while.
 	RenewBefore time.Duration
 
+	// RenewIdle optionally specifies how long a certificate may go without
+	// being requested through GetCertificate before the Manager stops
+	// renewing it. Such a certificate is loaded from cache again, and its
+	// renewal restarted, the next time it is requested while still valid.
+	//
+	// If zero, certificates are renewed for as long as the Manager runs.
+	RenewIdle time.Duration
+
+	// Budget optionally limits the rate at which the Manager requests
+	// certificates from the CA. Requests wait in a bounded queue, renewals
+	// ahead of new names, until they fit within the budget.
+	// Issued certificates and created orders are recorded in Cache.
+	//
+	// If nil, the rate of requests is not limited.
+	// Mutating the field after the first call of GetCertificate method will have no effect.
+	Budget *IssuanceBudget
+
 	// Client is used to perform low-level operations, such as account registration
 	// and requesting new certificates.
 	//
@@ -175,11 +194,33 @@ type Manager struct {
 	// in the template's ExtraExtensions field as is.
 	ExtraExtensions []pkix.Extension
 
+	// PreferredChain optionally selects among the certificate chains offered
+	// by an RFC 8555 CA, through Link headers with rel="alternate", the one
+	// whose topmost certificate is issued by this common name,
+	// e.g. "ISRG Root X1". Some older clients only trust a specific root.
+	//
+	// If empty, or if no chain matches, the CA's default chain is used.
+	PreferredChain string
+
+	// Profile optionally names the ACME certificate profile requested in
+	// new orders, such as "shortlived". It is ignored if the CA's directory
+	// does not advertise the profile.
+	Profile string
+
 	clientMu sync.Mutex
 	client   *acme.Client // initialized by acmeClient method
 
+	budgetMu sync.Mutex
+	budget   *issuanceQueue // initialized by issuanceQueue method
+
+	dirExtMu sync.Mutex
+	dirExt   *directoryExt // initialized by directoryExt method
+
 	stateMu sync.Mutex
 	state   map[certKey]*certState
+	// used records when each cert in state was last requested.
+	// It is guarded by stateMu.
+	used map[certKey]time.Time
 
 	// renewal tracks the set of domains currently running renewal timers.
 	renewalMu sync.Mutex
@@ -451,8 +492,18 @@ func stripPort(hostport string) string {
 // If a certificate is found in cache but not in m.state, the latter will be filled
 // with the cached value.
 func (m *Manager) cert(ctx context.Context, ck certKey) (*tls.Certificate, error) {
+	return m.loadCert(ctx, ck, true)
+}
+
+// loadCert is like cert, but records a request for the certificate only if
+// requested is true. A certificate loaded from cache without a request counts as
+// last requested when it was issued.
+func (m *Manager) loadCert(ctx context.Context, ck certKey, requested bool) (*tls.Certificate, error) {
 	m.stateMu.Lock()
 	if s, ok := m.state[ck]; ok {
+		if requested {
+			m.touch(ck)
+		}
 		m.stateMu.Unlock()
 		s.RLock()
 		defer s.RUnlock()
@@ -476,10 +527,82 @@ func (m *Manager) cert(ctx context.Context, ck certKey) (*tls.Certificate, error
 		leaf: cert.Leaf,
 	}
 	m.state[ck] = s
-	go m.renew(ck, s.key, s.leaf.NotAfter)
+	if requested {
+		m.touch(ck)
+	} else {
+		m.setUsed(ck, s.leaf.NotBefore)
+	}
+	go m.renew(ck, s.key, s.leaf)
 	return cert, nil
 }
 
+// touch records that the cert identified by ck was requested just now.
+// Callers must hold m.stateMu.
+func (m *Manager) touch(ck certKey) {
+	m.setUsed(ck, m.now())
+}
+
+// setUsed records that the cert identified by ck was last requested at t.
+// Callers must hold m.stateMu.
+func (m *Manager) setUsed(ck certKey, t time.Time) {
+	if m.used == nil {
+		m.used = make(map[certKey]time.Time)
+	}
+	m.used[ck] = t
+}
+
+// idle reports whether the cert identified by ck has not been requested
+// for longer than m.RenewIdle.
+func (m *Manager) idle(ck certKey) bool {
+	if m.RenewIdle <= 0 {
+		return false
+	}
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	t, ok := m.used[ck]
+	return ok && m.now().Sub(t) > m.RenewIdle
+}
+
+// RenewCached loads every certificate stored in m.Cache and starts its
+// renewal timer. It is meant to be called once at startup, so that
+// certificates which are not requested after a restart still get renewed.
+// Loading a certificate does not count as a request for the purposes of
+// RenewIdle: the certificate counts as last requested when it was issued.
+//
+// m.Cache must implement CacheLister. Entries which cannot be loaded
+// as a valid certificate, such as account keys or expired certs, are skipped.
+func (m *Manager) RenewCached(ctx context.Context) error {
+	lister, ok := m.Cache.(CacheLister)
+	if !ok {
+		return errors.New("acme/autocert: Cache does not implement CacheLister")
+	}
+	keys, err := lister.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		ck, ok := parseCertKey(key)
+		if !ok {
+			continue
+		}
+		m.loadCert(ctx, ck, false)
+	}
+	return nil
+}
+
+// parseCertKey is the reverse of certKey.String for regular domain certs.
+// It reports false for keys which cannot refer to such a cert.
+func parseCertKey(key string) (certKey, bool) {
+	i := strings.IndexByte(key, '+')
+	if i < 0 {
+		return certKey{domain: key}, key != ""
+	}
+	if key[i:] != "+rsa" {
+		return certKey{}, false
+	}
+	return certKey{domain: key[:i], isRSA: true}, true
+}
+
 // cacheGet always returns a valid certificate, or an error otherwise.
 // If a cached certificate exists but is not valid, ErrCacheMiss is returned.
 func (m *Manager) cacheGet(ctx context.Context, ck certKey) (*tls.Certificate, error) {
@@ -598,7 +721,7 @@ func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate,
 	defer state.Unlock()
 	state.locked = false
 
-	der, leaf, err := m.authorizedCert(ctx, state.key, ck)
+	der, leaf, err := m.authorizedCert(ctx, state.key, ck, nil)
 	if err != nil {
 		// Remove the failed state after some time,
 		// making the manager call createCert again on the following TLS hello.
@@ -621,7 +744,7 @@ func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate,
 	}
 	state.cert = der
 	state.leaf = leaf
-	go m.renew(ck, state.key, state.leaf.NotAfter)
+	go m.renew(ck, state.key, state.leaf)
 	return state.tlscert()
 }
 
@@ -659,17 +782,30 @@ func (m *Manager) certState(ck certKey) (*certState, error) {
 	}
 	state.Lock() // will be unlocked by m.certState caller
 	m.state[ck] = state
+	m.touch(ck)
 	return state, nil
 }
 
 // authorizedCert starts the domain ownership verification process and requests a new cert upon success.
 // The key argument is the certificate private key.
-func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey) (der [][]byte, leaf *x509.Certificate, err error) {
+// The replaces argument is the cert being renewed, if any. Renewals take
+// precedence within m.Budget and, if the CA supports ARI, name the cert
+// they replace in the new order.
+func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey, replaces *x509.Certificate) (der [][]byte, leaf *x509.Certificate, err error) {
 	csr, err := certRequest(key, ck.domain, m.ExtraExtensions)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	ticket, err := m.admitIssuance(ctx, replaces != nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// issued is set as soon as the CA hands out a cert,
+	// which counts against the budget even if the cert turns out to be invalid.
+	var issued bool
+	defer func() { ticket.done(context.Background(), issued) }()
+
 	client, err := m.acmeClient(ctx)
 	if err != nil {
 		return nil, nil, err
@@ -690,18 +826,21 @@ func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck cert
 		if err != nil {
 			return nil, nil, err
 		}
+		issued = true
 		chain = der
 	// RFC 8555 compliant CA.
 	default:
-		o, err := m.verifyRFC(ctx, client, ck.domain)
+		opts := m.orderOptions(ctx, replaces)
+		o, err := m.verifyRFC(ctx, client, ck.domain, opts, ticket)
 		if err != nil {
 			return nil, nil, err
 		}
-		der, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+		der, certURL, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
 		if err != nil {
 			return nil, nil, err
 		}
-		chain = der
+		issued = true
+		chain = m.preferredChain(ctx, client, der, certURL)
 	}
 	leaf, err = validCert(ck, chain, key, m.now())
 	if err != nil {
@@ -775,7 +914,8 @@ func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string
 
 // verifyRFC runs the identifier (domain) order-based authorization flow for RFC compliant CAs
 // using each applicable ACME challenge type.
-func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, domain string) (*acme.Order, error) {
+// Every order created with opts is recorded on the ticket.
+func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, domain string, opts orderOptions, ticket *issuanceTicket) (*acme.Order, error) {
 	// Try each supported challenge type starting with a new order each time.
 	// The nextTyp index of the next challenge type to try is shared across
 	// all order authorizations: if we've tried a challenge type once and it didn't work,
@@ -784,10 +924,11 @@ func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, domain str
 	nextTyp := 0 // challengeTypes index
 AuthorizeOrderLoop:
 	for {
-		o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+		o, err := m.authorizeOrder(ctx, client, domain, opts)
 		if err != nil {
 			return nil, err
 		}
+		ticket.order(ctx)
 		// Remove all hanging authorizations to reduce rate limit quotas
 		// after we're done.
 		defer func(urls []string) {
@@ -1017,8 +1158,14 @@ func (m *Manager) deleteDNSToken(ctx context.Context, domain string) {
 // - a new cert was created by m.createCert
 //
 // The key argument is a certificate private key.
-// The exp argument is the cert expiration time (NotAfter).
-func (m *Manager) renew(ck certKey, key crypto.Signer, exp time.Time) {
+// The leaf argument is the cert whose validity period sets the schedule.
+func (m *Manager) renew(ck certKey, key crypto.Signer, leaf *x509.Certificate) {
+	// Learn whether the CA supports ARI before the first renewal is scheduled.
+	// The result is cached, and failures only mean the regular schedule applies.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	m.directoryExt(ctx)
+	cancel()
+
 	m.renewalMu.Lock()
 	defer m.renewalMu.Unlock()
 	if m.renewal[ck] != nil {
@@ -1030,7 +1177,24 @@ func (m *Manager) renew(ck certKey, key crypto.Signer, exp time.Time) {
 	}
 	dr := &domainRenewal{m: m, ck: ck, key: key}
 	m.renewal[ck] = dr
-	dr.start(exp)
+	dr.start(leaf)
+	dr.startOCSP()
+}
+
+// forgetRenewal removes dr from the running renewals together with the
+// in-memory state of its cert, so that the next request for the cert
+// reloads it from cache and restarts the renewal timer.
+func (m *Manager) forgetRenewal(dr *domainRenewal) {
+	m.renewalMu.Lock()
+	if m.renewal[dr.ck] == dr {
+		delete(m.renewal, dr.ck)
+	}
+	m.renewalMu.Unlock()
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	delete(m.state, dr.ck)
+	delete(m.used, dr.ck)
 }
 
 // stopRenew stops all currently running cert renewal timers.
@@ -1131,6 +1295,23 @@ func isAccountAlreadyExist(err error) bool {
 	return ok && ae.StatusCode == http.StatusConflict
 }
 
+// directoryURL returns the CA's directory URL the Manager uses.
+func (m *Manager) directoryURL() string {
+	if m.Client != nil && m.Client.DirectoryURL != "" {
+		return m.Client.DirectoryURL
+	}
+	return DefaultACMEDirectory
+}
+
+// httpClient returns the HTTP client for requests the Manager
+// sends to the CA itself, rather than through the acme.Client.
+func (m *Manager) httpClient() *http.Client {
+	if m.Client != nil && m.Client.HTTPClient != nil {
+		return m.Client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
 func (m *Manager) hostPolicy() HostPolicy {
 	if m.HostPolicy != nil {
 		return m.HostPolicy
@@ -1138,11 +1319,19 @@ func (m *Manager) hostPolicy() HostPolicy {
 	return defaultHostPolicy
 }
 
-func (m *Manager) renewBefore() time.Duration {
+// renewBefore returns how long before its expiry leaf is renewed.
+// Short-lived certs, e.g. of a 6-day ACME profile, are renewed when
+// a third of their lifetime remains, so that a fresh cert isn't renewed
+// right away.
+func (m *Manager) renewBefore(leaf *x509.Certificate) time.Duration {
+	d := 720 * time.Hour // 30 days
 	if m.RenewBefore > renewJitter {
-		return m.RenewBefore
+		d = m.RenewBefore
+	}
+	if third := leaf.NotAfter.Sub(leaf.NotBefore) / 3; third < d {
+		d = third
 	}
-	return 720 * time.Hour // 30 days
+	return d
 }
 
 func (m *Manager) now() time.Time {
@@ -1159,6 +1348,7 @@ type certState struct {
 	key    crypto.Signer     // private key for cert
 	cert   [][]byte          // DER encoding
 	leaf   *x509.Certificate // parsed cert[0]; always non-nil if cert != nil
+	ocsp   []byte            // OCSP response for leaf, if any; see refreshOCSP
 }
 
 // tlscert creates a tls.Certificate from s.key and s.cert.
@@ -1174,6 +1364,7 @@ func (s *certState) tlscert() (*tls.Certificate, error) {
 		PrivateKey:  s.key,
 		Certificate: s.cert,
 		Leaf:        s.leaf,
+		OCSPStaple:  s.ocsp,
 	}, nil
 }
 
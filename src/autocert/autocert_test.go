@@ -120,6 +120,17 @@ func (m *memCache) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+func (m *memCache) List(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.keyData {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 func newMemCache(t *testing.T) *memCache {
 	return &memCache{
 		t:       t,
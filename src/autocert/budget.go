@@ -0,0 +1,391 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIssuanceBudget is returned when a certificate request is refused
+// because it would exceed the Manager's IssuanceBudget.
+var ErrIssuanceBudget = errors.New("acme/autocert: issuance budget exceeded")
+
+// budgetLedgerKey is the cache key of the persisted issuance ledger.
+const budgetLedgerKey = "acme_budget+ledger"
+
+// defaultQueueSize is the number of requests which may wait for issuance
+// budget when IssuanceBudget.QueueSize is zero.
+const defaultQueueSize = 100
+
+// RateLimit is a maximum number of events within a sliding time window.
+type RateLimit struct {
+	// Limit is the maximum number of events within Window.
+	// If zero, the number of events is not limited.
+	Limit int
+
+	// Window is the length of the sliding window.
+	Window time.Duration
+}
+
+// IssuanceBudget keeps a Manager within the rate limits imposed by its CA.
+//
+// Let's Encrypt, for instance, allows 50 certificates per registered domain
+// every 7 days and 300 new orders per account every 3 hours. When all
+// managed names share a registered domain, the former is easily exhausted.
+type IssuanceBudget struct {
+	// Certificates limits the number of certificates issued,
+	// new names and renewals alike.
+	Certificates RateLimit
+
+	// Orders limits the number of ACME orders created. Every attempt
+	// to authorize a name counts, whether or not a certificate is issued.
+	Orders RateLimit
+
+	// RenewalReserve is the number of certificates within the Certificates
+	// limit which only renewals may use. Requests for new names wait
+	// while fewer than that remain.
+	RenewalReserve int
+
+	// QueueSize bounds the number of requests waiting for budget.
+	// Requests which don't fit are refused with ErrIssuanceBudget.
+	// If zero, 100 is used.
+	QueueSize int
+}
+
+// budgetLedger records when certificates were issued and orders were created.
+// It is persisted in the Manager's Cache so it survives restarts.
+type budgetLedger struct {
+	Certificates []time.Time `json:"certificates"`
+	Orders       []time.Time `json:"orders"`
+}
+
+// issuanceQueue admits certificate requests within an IssuanceBudget,
+// serving renewals before new names.
+type issuanceQueue struct {
+	m      *Manager
+	budget IssuanceBudget
+
+	mu            sync.Mutex
+	loaded        bool
+	ledger        budgetLedger
+	pending       int // admitted tickets which have not finished yet
+	pendingOrders int // admitted tickets which have not created an order yet
+	// waiting holds tickets not yet admitted, renewals at index 0
+	// and new names at index 1.
+	waiting [2][]*issuanceTicket
+	// timer runs dispatch when the oldest ledger entry leaves its window.
+	timer *time.Timer
+}
+
+// issuanceTicket is a single request for a certificate passing through
+// an issuanceQueue. A nil ticket, used when there is no budget, is valid
+// and all its methods are noops.
+type issuanceTicket struct {
+	q        *issuanceQueue
+	renewal  bool
+	ready    chan struct{} // closed upon admission
+	admitted bool
+	ordered  bool // at least one order was created
+}
+
+// issuanceQueue returns the Manager's issuance queue,
+// or nil if m.Budget is nil.
+func (m *Manager) issuanceQueue() *issuanceQueue {
+	if m.Budget == nil {
+		return nil
+	}
+	m.budgetMu.Lock()
+	defer m.budgetMu.Unlock()
+	if m.budget == nil {
+		m.budget = &issuanceQueue{m: m, budget: *m.Budget}
+	}
+	return m.budget
+}
+
+// admitIssuance blocks until a request for a new certificate fits within
+// m.Budget. Renewals take precedence over new names.
+//
+// It returns ErrIssuanceBudget right away if the queue is full, or if
+// the budget cannot free up before the ctx deadline.
+// Callers must call done on the returned ticket once they are finished.
+func (m *Manager) admitIssuance(ctx context.Context, renewal bool) (*issuanceTicket, error) {
+	q := m.issuanceQueue()
+	if q == nil {
+		return nil, nil
+	}
+
+	q.mu.Lock()
+	if err := q.load(ctx); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	if len(q.waiting[0])+len(q.waiting[1]) >= q.queueSize() {
+		q.mu.Unlock()
+		return nil, ErrIssuanceBudget
+	}
+	t := &issuanceTicket{q: q, renewal: renewal, ready: make(chan struct{})}
+	i := t.priority()
+	q.waiting[i] = append(q.waiting[i], t)
+	q.dispatch()
+	if !t.admitted {
+		if deadline, ok := ctx.Deadline(); ok && q.availableAt(renewal).After(deadline) {
+			q.remove(t)
+			q.mu.Unlock()
+			return nil, ErrIssuanceBudget
+		}
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return t, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if t.admitted {
+			q.finish(ctx, t, false)
+		} else {
+			q.remove(t)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// order records that the ticket holder created a new ACME order.
+func (t *issuanceTicket) order(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !t.ordered {
+		t.ordered = true
+		q.pendingOrders--
+	}
+	q.ledger.Orders = append(q.ledger.Orders, q.m.now())
+	q.save(ctx)
+}
+
+// done releases the ticket's share of the budget.
+// The issued argument reports whether a certificate was actually issued.
+func (t *issuanceTicket) done(ctx context.Context, issued bool) {
+	if t == nil {
+		return
+	}
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finish(ctx, t, issued)
+}
+
+// finish is done for callers already holding q.mu.
+func (q *issuanceQueue) finish(ctx context.Context, t *issuanceTicket, issued bool) {
+	q.pending--
+	if !t.ordered {
+		q.pendingOrders--
+	}
+	if issued {
+		q.ledger.Certificates = append(q.ledger.Certificates, q.m.now())
+		q.save(ctx)
+	}
+	q.dispatch()
+}
+
+func (t *issuanceTicket) priority() int {
+	if t.renewal {
+		return 0
+	}
+	return 1
+}
+
+// remove drops a ticket which hasn't been admitted from the queue.
+// Callers must hold q.mu.
+func (q *issuanceQueue) remove(t *issuanceTicket) {
+	i := t.priority()
+	for j, w := range q.waiting[i] {
+		if w == t {
+			q.waiting[i] = append(q.waiting[i][:j], q.waiting[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch admits waiting tickets for as long as the budget allows,
+// renewals first. New names are never admitted ahead of a waiting renewal.
+// Callers must hold q.mu.
+func (q *issuanceQueue) dispatch() {
+	q.prune()
+	for i, renewal := range []bool{true, false} {
+		for len(q.waiting[i]) > 0 && q.allowed(renewal) {
+			t := q.waiting[i][0]
+			q.waiting[i] = q.waiting[i][1:]
+			t.admitted = true
+			q.pending++
+			q.pendingOrders++
+			close(t.ready)
+		}
+		if len(q.waiting[i]) > 0 {
+			break
+		}
+	}
+
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	if len(q.waiting[0])+len(q.waiting[1]) == 0 {
+		return
+	}
+	// Blocked by pending tickets only: finish will dispatch again.
+	at := q.nextExpiry()
+	if at.IsZero() {
+		return
+	}
+	d := at.Sub(q.m.now())
+	if d < 0 {
+		d = 0
+	}
+	q.timer = time.AfterFunc(d, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.dispatch()
+	})
+}
+
+// allowed reports whether one more request fits within the budget.
+// Callers must hold q.mu.
+func (q *issuanceQueue) allowed(renewal bool) bool {
+	if limit := q.budget.Certificates.Limit; limit > 0 {
+		if !renewal {
+			limit -= q.budget.RenewalReserve
+		}
+		if len(q.ledger.Certificates)+q.pending >= limit {
+			return false
+		}
+	}
+	if limit := q.budget.Orders.Limit; limit > 0 {
+		if len(q.ledger.Orders)+q.pendingOrders >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+// availableAt estimates the earliest time at which a request could be
+// admitted, as ledger entries leave their windows. It does not account
+// for other waiting tickets.
+// Callers must hold q.mu.
+func (q *issuanceQueue) availableAt(renewal bool) time.Time {
+	var at time.Time
+	if limit := q.budget.Certificates.Limit; limit > 0 {
+		if !renewal {
+			limit -= q.budget.RenewalReserve
+		}
+		if t := expiryFor(q.ledger.Certificates, q.pending, limit, q.budget.Certificates.Window); t.After(at) {
+			at = t
+		}
+	}
+	if limit := q.budget.Orders.Limit; limit > 0 {
+		if t := expiryFor(q.ledger.Orders, q.pendingOrders, limit, q.budget.Orders.Window); t.After(at) {
+			at = t
+		}
+	}
+	return at
+}
+
+// expiryFor returns the time at which enough of the sorted entries have
+// left the window for one more event to fit within limit.
+// It returns the zero time if that is already the case, or if pending
+// events alone exceed the limit.
+func expiryFor(entries []time.Time, pending, limit int, window time.Duration) time.Time {
+	n := len(entries) + pending - limit + 1 // entries which have to expire
+	if n <= 0 || n > len(entries) {
+		return time.Time{}
+	}
+	return entries[n-1].Add(window)
+}
+
+// nextExpiry returns the time at which the oldest ledger entry leaves its
+// window, or the zero time if the ledger is empty.
+// Callers must hold q.mu.
+func (q *issuanceQueue) nextExpiry() time.Time {
+	var at time.Time
+	if len(q.ledger.Certificates) > 0 {
+		at = q.ledger.Certificates[0].Add(q.budget.Certificates.Window)
+	}
+	if len(q.ledger.Orders) > 0 {
+		t := q.ledger.Orders[0].Add(q.budget.Orders.Window)
+		if at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	return at
+}
+
+// prune removes ledger entries which have left their windows.
+// Callers must hold q.mu.
+func (q *issuanceQueue) prune() {
+	now := q.m.now()
+	q.ledger.Certificates = pruneBefore(q.ledger.Certificates, now.Add(-q.budget.Certificates.Window))
+	q.ledger.Orders = pruneBefore(q.ledger.Orders, now.Add(-q.budget.Orders.Window))
+}
+
+// pruneBefore returns the sorted entries which are not before t.
+func pruneBefore(entries []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(entries) && entries[i].Before(t) {
+		i++
+	}
+	return entries[i:]
+}
+
+func (q *issuanceQueue) queueSize() int {
+	if q.budget.QueueSize > 0 {
+		return q.budget.QueueSize
+	}
+	return defaultQueueSize
+}
+
+// load reads the persisted ledger from the Manager's Cache once.
+// Callers must hold q.mu.
+func (q *issuanceQueue) load(ctx context.Context) error {
+	if q.loaded || q.m.Cache == nil {
+		return nil
+	}
+	data, err := q.m.Cache.Get(ctx, budgetLedgerKey)
+	if err == ErrCacheMiss {
+		q.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &q.ledger); err != nil {
+		// A corrupt ledger is replaced by a fresh one on the next save.
+		q.ledger = budgetLedger{}
+	}
+	q.loaded = true
+	return nil
+}
+
+// save persists the ledger in the Manager's Cache,
+// ignoring any error returned from Cache.Put.
+// Callers must hold q.mu.
+func (q *issuanceQueue) save(ctx context.Context) {
+	if q.m.Cache == nil {
+		return
+	}
+	q.prune()
+	data, err := json.Marshal(&q.ledger)
+	if err != nil {
+		return
+	}
+	q.m.Cache.Put(ctx, budgetLedgerKey, data)
+}
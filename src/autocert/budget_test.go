@@ -0,0 +1,208 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newBudgetManager(t *testing.T, now time.Time, b IssuanceBudget) *Manager {
+	return &Manager{
+		Cache:   newMemCache(t),
+		Budget:  &b,
+		nowFunc: func() time.Time { return now },
+	}
+}
+
+func TestIssuanceBudgetLedger(t *testing.T) {
+	now := time.Now()
+	b := IssuanceBudget{
+		Certificates: RateLimit{Limit: 2, Window: 7 * 24 * time.Hour},
+		Orders:       RateLimit{Limit: 10, Window: 3 * time.Hour},
+	}
+	man := newBudgetManager(t, now, b)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		ticket, err := man.admitIssuance(ctx, false)
+		if err != nil {
+			t.Fatalf("%d: admitIssuance: %v", i, err)
+		}
+		ticket.order(ctx)
+		ticket.done(ctx, true)
+	}
+
+	data, err := man.Cache.Get(ctx, budgetLedgerKey)
+	if err != nil {
+		t.Fatalf("ledger not cached: %v", err)
+	}
+	var ledger budgetLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		t.Fatal(err)
+	}
+	if len(ledger.Certificates) != 2 || len(ledger.Orders) != 2 {
+		t.Errorf("ledger = %+v; want 2 certificates and 2 orders", ledger)
+	}
+
+	// A new Manager sharing the cache sees the exhausted budget
+	// and refuses requests which can't wait for the window to move.
+	man2 := newBudgetManager(t, now, b)
+	man2.Cache = man.Cache
+	ctx2, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if _, err := man2.admitIssuance(ctx2, true); err != ErrIssuanceBudget {
+		t.Errorf("admitIssuance: %v; want ErrIssuanceBudget", err)
+	}
+
+	// Entries outside the window no longer count.
+	man3 := newBudgetManager(t, now.Add(8*24*time.Hour), b)
+	man3.Cache = man.Cache
+	ticket, err := man3.admitIssuance(ctx2, false)
+	if err != nil {
+		t.Fatalf("admitIssuance after window: %v", err)
+	}
+	ticket.done(ctx, false)
+}
+
+func TestIssuanceBudgetPriority(t *testing.T) {
+	now := time.Now()
+	man := newBudgetManager(t, now, IssuanceBudget{
+		Certificates: RateLimit{Limit: 1, Window: time.Hour},
+	})
+	ctx := context.Background()
+
+	first, err := man.admitIssuance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan bool, 2)
+	wait := func(renewal bool) {
+		ticket, err := man.admitIssuance(ctx, renewal)
+		if err != nil {
+			t.Errorf("admitIssuance(%v): %v", renewal, err)
+			return
+		}
+		admitted <- renewal
+		ticket.done(ctx, false)
+	}
+	waitQueued := func(n int) {
+		for {
+			q := man.issuanceQueue()
+			q.mu.Lock()
+			l := len(q.waiting[0]) + len(q.waiting[1])
+			q.mu.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go wait(false)
+	waitQueued(1)
+	go wait(true)
+	waitQueued(2)
+
+	// Release without issuing: the renewal goes first.
+	first.done(ctx, false)
+	for _, want := range []bool{true, false} {
+		select {
+		case got := <-admitted:
+			if got != want {
+				t.Errorf("admitted renewal = %v; want %v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("request was not admitted")
+		}
+	}
+}
+
+func TestIssuanceBudgetRenewalReserve(t *testing.T) {
+	now := time.Now()
+	man := newBudgetManager(t, now, IssuanceBudget{
+		Certificates:   RateLimit{Limit: 3, Window: time.Hour},
+		RenewalReserve: 2,
+	})
+	ctx := context.Background()
+
+	newName, err := man.admitIssuance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newName.done(ctx, true)
+
+	// The rest of the budget is reserved for renewals.
+	ctx2, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if _, err := man.admitIssuance(ctx2, false); err != ErrIssuanceBudget {
+		t.Errorf("admitIssuance new name: %v; want ErrIssuanceBudget", err)
+	}
+	renewal, err := man.admitIssuance(ctx2, true)
+	if err != nil {
+		t.Fatalf("admitIssuance renewal: %v", err)
+	}
+	renewal.done(ctx, true)
+}
+
+func TestIssuanceBudgetQueueFull(t *testing.T) {
+	now := time.Now()
+	man := newBudgetManager(t, now, IssuanceBudget{
+		Certificates: RateLimit{Limit: 1, Window: time.Hour},
+		QueueSize:    1,
+	})
+	ctx := context.Background()
+
+	ticket, err := man.admitIssuance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ticket.done(ctx, false)
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := man.admitIssuance(waitCtx, false)
+		errc <- err
+	}()
+	q := man.issuanceQueue()
+	for {
+		q.mu.Lock()
+		l := len(q.waiting[1])
+		q.mu.Unlock()
+		if l == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := man.admitIssuance(ctx, true); err != ErrIssuanceBudget {
+		t.Errorf("admitIssuance with full queue: %v; want ErrIssuanceBudget", err)
+	}
+
+	// A canceled waiter leaves the queue.
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("canceled admitIssuance: %v; want context.Canceled", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l := len(q.waiting[0]) + len(q.waiting[1]); l != 0 {
+		t.Errorf("%d tickets still waiting", l)
+	}
+}
+
+func TestIssuanceBudgetNil(t *testing.T) {
+	man := &Manager{}
+	ticket, err := man.admitIssuance(context.Background(), false)
+	if ticket != nil || err != nil {
+		t.Errorf("admitIssuance = %v, %v; want nil, nil", ticket, err)
+	}
+	// nil tickets are noops
+	ticket.order(context.Background())
+	ticket.done(context.Background(), true)
+}
@@ -35,6 +35,13 @@ type Cache interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// CacheLister is implemented by Cache implementations which can enumerate
+// the keys they hold. Manager.RenewCached requires it.
+type CacheLister interface {
+	// List returns the keys of all entries currently stored in the cache.
+	List(ctx context.Context) ([]string, error)
+}
+
 // DirCache implements Cache using a directory on the local filesystem.
 // If the directory does not exist, it will be created with 0700 permissions.
 type DirCache string
@@ -116,6 +123,35 @@ func (d DirCache) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
+// List returns the names of all files in the cache directory.
+// A nonexistent directory is treated as an empty cache.
+func (d DirCache) List(ctx context.Context) ([]string, error) {
+	var (
+		names []string
+		err   error
+		done  = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		var infos []os.FileInfo
+		infos, err = ioutil.ReadDir(string(d))
+		for _, fi := range infos {
+			if fi.Mode().IsRegular() {
+				names = append(names, fi.Name())
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
 // writeTempFile writes b to a temporary file, closes the file and returns its path.
 func (d DirCache) writeTempFile(prefix string, b []byte) (name string, reterr error) {
 	// TempFile uses 0600 permissions
@@ -13,8 +13,11 @@ import (
 	"testing"
 )
 
-// make sure DirCache satisfies Cache interface
-var _ Cache = DirCache("/")
+// make sure DirCache satisfies Cache and CacheLister interfaces
+var (
+	_ Cache       = DirCache("/")
+	_ CacheLister = DirCache("/")
+)
 
 func TestDirCache(t *testing.T) {
 	dir, err := ioutil.TempDir("", "autocert")
@@ -31,6 +34,11 @@ func TestDirCache(t *testing.T) {
 		t.Errorf("get: %v; want ErrCacheMiss", err)
 	}
 
+	// test list of a nonexistent dir
+	if keys, err := cache.List(ctx); err != nil || len(keys) != 0 {
+		t.Errorf("list: %v, %v; want no keys", keys, err)
+	}
+
 	// test put/get
 	b1 := []byte{1}
 	if err := cache.Put(ctx, "dummy", b1); err != nil {
@@ -57,6 +65,15 @@ func TestDirCache(t *testing.T) {
 		t.Errorf("temp file exists: %s", tmp)
 	}
 
+	// test list
+	keys, err := cache.List(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"dummy"}) {
+		t.Errorf("list: %v; want [dummy]", keys)
+	}
+
 	// test delete
 	if err := cache.Delete(ctx, "dummy"); err != nil {
 		t.Fatalf("delete: %v", err)
@@ -0,0 +1,165 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspMinRefresh is the shortest interval between two OCSP requests
+	// for the same cert.
+	ocspMinRefresh = time.Hour
+	// ocspRetry is how long to wait after a failed OCSP request.
+	ocspRetry = 15 * time.Minute
+)
+
+// errNoOCSP is returned for certs which do not name an OCSP responder.
+var errNoOCSP = errors.New("acme/autocert: no OCSP responder")
+
+// MustStapleExtension is the TLS Feature extension (RFC 7633) with the
+// status_request feature, also known as OCSP Must-Staple. Adding it to
+// Manager.ExtraExtensions makes clients reject the certificate when served
+// without a valid OCSP staple.
+var MustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05}, // SEQUENCE { INTEGER 5 }
+}
+
+// ocspStaple requests the revocation status of the leaf in chain from its
+// OCSP responder. It returns the raw response, suitable for
+// tls.Certificate.OCSPStaple, and the time at which it should be refreshed.
+//
+// Only responses with the status Good are returned.
+func (m *Manager) ocspStaple(ctx context.Context, chain [][]byte) ([]byte, time.Time, error) {
+	if len(chain) < 2 {
+		return nil, time.Time{}, errNoOCSP
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, time.Time{}, errNoOCSP
+	}
+	issuer, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	reqDER, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	req, err := http.NewRequest("POST", leaf.OCSPServer[0], bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	res, err := m.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("acme/autocert: OCSP responder returned %s", res.Status)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, time.Time{}, fmt.Errorf("acme/autocert: OCSP status of %q is not good", leaf.Subject.CommonName)
+	}
+
+	// Refresh halfway through the validity of the response.
+	refresh := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if min := m.now().Add(ocspMinRefresh); refresh.Before(min) {
+		refresh = min
+	}
+	return raw, refresh, nil
+}
+
+// startOCSP starts refreshing the OCSP staple of the cert right away.
+// If the refresh loop is already running, it is rescheduled to run now,
+// which is what a renewal needs.
+func (dr *domainRenewal) startOCSP() {
+	dr.ocspMu.Lock()
+	defer dr.ocspMu.Unlock()
+	if dr.ocspTimer != nil {
+		dr.ocspTimer.Reset(0)
+		return
+	}
+	dr.ocspTimer = time.AfterFunc(0, dr.refreshOCSP)
+}
+
+// stopOCSP stops the OCSP refresh loop.
+// If the loop is already stopped, calling stopOCSP is a noop.
+func (dr *domainRenewal) stopOCSP() {
+	dr.ocspMu.Lock()
+	defer dr.ocspMu.Unlock()
+	if dr.ocspTimer == nil {
+		return
+	}
+	dr.ocspTimer.Stop()
+	dr.ocspTimer = nil
+}
+
+// refreshOCSP is called periodically by a timer, fetching a new OCSP staple
+// for the cert currently held in Manager.state.
+// The loop ends for certs which don't name an OCSP responder.
+func (dr *domainRenewal) refreshOCSP() {
+	dr.ocspMu.Lock()
+	defer dr.ocspMu.Unlock()
+	if dr.ocspTimer == nil {
+		return
+	}
+
+	dr.m.stateMu.Lock()
+	s := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	if s == nil {
+		dr.ocspTimer = nil
+		return
+	}
+	s.RLock()
+	chain := s.cert
+	s.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	staple, refresh, err := dr.m.ocspStaple(ctx, chain)
+	switch {
+	case err == errNoOCSP:
+		dr.ocspTimer = nil
+	case err != nil:
+		dr.ocspTimer = time.AfterFunc(ocspRetry, dr.refreshOCSP)
+	default:
+		s.Lock()
+		s.ocsp = staple
+		s.Unlock()
+		dr.ocspTimer = time.AfterFunc(refresh.Sub(dr.m.now()), dr.refreshOCSP)
+	}
+	testDidRefreshOCSP(staple, err)
+}
+
+var testDidRefreshOCSP = func(staple []byte, err error) {}
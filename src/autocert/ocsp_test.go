@@ -0,0 +1,243 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// startOCSPResponderStub returns an issuer cert, its key and an OCSP responder
+// answering with the given status for any cert of the issuer.
+func startOCSPResponderStub(t *testing.T, status int, thisUpdate, nextUpdate time.Time) (*x509.Certificate, *ecdsa.PrivateKey, *httptest.Server) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OCSP Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			t.Errorf("Content-Type = %q; want application/ocsp-request", ct)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			t.Errorf("ocsp.ParseRequest: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+			RevokedAt:    thisUpdate,
+		}, key)
+		if err != nil {
+			t.Errorf("ocsp.CreateResponse: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(res)
+	}))
+	return issuer, key, responder
+}
+
+// ocspTestChain returns a chain of a leaf issued by issuer and the issuer,
+// where the leaf names ocspServer as its OCSP responder.
+func ocspTestChain(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, ocspServer string) [][]byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: exampleDomain},
+		DNSNames:     []string{exampleDomain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{der, issuer.Raw}
+}
+
+func TestOCSPStaple(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Good, now, now.Add(96*time.Hour))
+	defer responder.Close()
+
+	man := &Manager{nowFunc: func() time.Time { return now }}
+	chain := ocspTestChain(t, issuer, key, responder.URL)
+	staple, refresh, err := man.ocspStaple(context.Background(), chain)
+	if err != nil {
+		t.Fatalf("ocspStaple: %v", err)
+	}
+	if _, err := ocsp.ParseResponse(staple, issuer); err != nil {
+		t.Errorf("ocsp.ParseResponse: %v", err)
+	}
+	if want := now.Add(48 * time.Hour); !refresh.Equal(want) {
+		t.Errorf("refresh = %v; want %v", refresh, want)
+	}
+
+	// The staple is served along with the cert.
+	leaf, _ := x509.ParseCertificate(chain[0])
+	s := &certState{key: key, cert: chain, leaf: leaf, ocsp: staple}
+	tlscert, err := s.tlscert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tlscert.OCSPStaple, staple) {
+		t.Error("tlscert: OCSPStaple not set")
+	}
+}
+
+func TestOCSPStapleMinRefresh(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Good, now, now.Add(time.Minute))
+	defer responder.Close()
+
+	man := &Manager{nowFunc: func() time.Time { return now }}
+	_, refresh, err := man.ocspStaple(context.Background(), ocspTestChain(t, issuer, key, responder.URL))
+	if err != nil {
+		t.Fatalf("ocspStaple: %v", err)
+	}
+	if want := now.Add(ocspMinRefresh); !refresh.Equal(want) {
+		t.Errorf("refresh = %v; want %v", refresh, want)
+	}
+}
+
+func TestOCSPStapleRevoked(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Revoked, now, now.Add(96*time.Hour))
+	defer responder.Close()
+
+	man := &Manager{}
+	if _, _, err := man.ocspStaple(context.Background(), ocspTestChain(t, issuer, key, responder.URL)); err == nil {
+		t.Error("ocspStaple: want error for a revoked cert")
+	}
+}
+
+func TestOCSPStapleNoResponder(t *testing.T) {
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Good, time.Now(), time.Now().Add(time.Hour))
+	defer responder.Close()
+
+	man := &Manager{}
+	chain := ocspTestChain(t, issuer, key, "")
+	if _, _, err := man.ocspStaple(context.Background(), chain); err != errNoOCSP {
+		t.Errorf("ocspStaple = %v; want errNoOCSP", err)
+	}
+	if _, _, err := man.ocspStaple(context.Background(), chain[:1]); err != errNoOCSP {
+		t.Errorf("ocspStaple without issuer = %v; want errNoOCSP", err)
+	}
+}
+
+func TestRefreshOCSP(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Good, now, now.Add(96*time.Hour))
+	defer responder.Close()
+
+	chain := ocspTestChain(t, issuer, key, responder.URL)
+	leaf, _ := x509.ParseCertificate(chain[0])
+	man := &Manager{}
+	ck := certKey{domain: exampleDomain}
+	s := &certState{key: key, cert: chain, leaf: leaf}
+	man.state = map[certKey]*certState{ck: s}
+
+	done := make(chan error, 1)
+	defer func() { testDidRefreshOCSP = func([]byte, error) {} }()
+	testDidRefreshOCSP = func(staple []byte, err error) {
+		done <- err
+	}
+
+	dr := &domainRenewal{m: man, ck: ck, key: key}
+	dr.startOCSP()
+	defer dr.stopOCSP()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("refreshOCSP: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OCSP staple was not refreshed")
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.ocsp) == 0 {
+		t.Error("refreshOCSP: staple not stored in the cert state")
+	}
+}
+
+func TestUpdateStateKeepsOCSP(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer, key, responder := startOCSPResponderStub(t, ocsp.Good, now, now.Add(96*time.Hour))
+	defer responder.Close()
+
+	chain := ocspTestChain(t, issuer, key, responder.URL)
+	leaf, _ := x509.ParseCertificate(chain[0])
+	man := &Manager{}
+	ck := certKey{domain: exampleDomain}
+	staple := []byte("staple")
+	man.state = map[certKey]*certState{ck: {key: key, cert: chain, leaf: leaf, ocsp: staple}}
+
+	refreshed := make(chan struct{}, 1)
+	defer func() { testDidRefreshOCSP = func([]byte, error) {} }()
+	testDidRefreshOCSP = func([]byte, error) {
+		refreshed <- struct{}{}
+	}
+
+	// The OCSP timer is running for the unchanged cert.
+	dr := &domainRenewal{m: man, ck: ck, key: key}
+	dr.ocspTimer = time.AfterFunc(time.Hour, dr.refreshOCSP)
+	defer dr.stopOCSP()
+
+	dr.updateState(&certState{key: key, cert: chain, leaf: leaf})
+	s := man.state[ck]
+	s.RLock()
+	if !bytes.Equal(s.ocsp, staple) {
+		t.Errorf("ocsp = %q; want %q", s.ocsp, staple)
+	}
+	s.RUnlock()
+	select {
+	case <-refreshed:
+		t.Error("OCSP staple refreshed for an unchanged cert")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
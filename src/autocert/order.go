@@ -0,0 +1,355 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// orderOptions holds newOrder fields which acme.Client.AuthorizeOrder
+// cannot send. The zero value requests a plain order.
+type orderOptions struct {
+	replaces string // ARI certID of the cert being replaced
+	profile  string // certificate profile name
+}
+
+// errAlreadyReplaced is the ACME problem type returned by a CA when the cert
+// named by an order's replaces field has already been replaced.
+const errAlreadyReplaced = "urn:ietf:params:acme:error:alreadyReplaced"
+
+// orderOptions returns the options for a new order replacing the given cert,
+// which may be nil, limited to what the CA's directory says it supports.
+func (m *Manager) orderOptions(ctx context.Context, replaces *x509.Certificate) orderOptions {
+	var opts orderOptions
+	ext, err := m.directoryExt(ctx)
+	if err != nil {
+		return opts
+	}
+	if replaces != nil && ext.RenewalInfo != "" {
+		opts.replaces, _ = ariCertID(replaces)
+	}
+	if _, ok := ext.Meta.Profiles[m.Profile]; ok && m.Profile != "" {
+		opts.profile = m.Profile
+	}
+	return opts
+}
+
+// preferredChain returns the chain issued by m.PreferredChain among chain,
+// as returned by the CA for certURL, and its alternates.
+// It falls back to chain if none matches or the alternates can't be fetched.
+func (m *Manager) preferredChain(ctx context.Context, client *acme.Client, chain [][]byte, certURL string) [][]byte {
+	if m.PreferredChain == "" || chainIssuedBy(chain, m.PreferredChain) {
+		return chain
+	}
+	alts, err := client.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		return chain
+	}
+	for _, u := range alts {
+		der, err := client.FetchCert(ctx, u, true)
+		if err == nil && chainIssuedBy(der, m.PreferredChain) {
+			return der
+		}
+	}
+	return chain
+}
+
+// chainIssuedBy reports whether the topmost cert of chain
+// is issued by the common name cn.
+func chainIssuedBy(chain [][]byte, cn string) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	top, err := x509.ParseCertificate(chain[len(chain)-1])
+	return err == nil && top.Issuer.CommonName == cn
+}
+
+// authorizeOrder creates a new order for domain.
+// Orders with non-zero opts are sent by the Manager itself, signed with the
+// account key of client, because acme.Client has no way to include them.
+func (m *Manager) authorizeOrder(ctx context.Context, client *acme.Client, domain string, opts orderOptions) (*acme.Order, error) {
+	if opts == (orderOptions{}) {
+		return client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	}
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type wireID struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	req := struct {
+		Identifiers []wireID `json:"identifiers"`
+		Replaces    string   `json:"replaces,omitempty"`
+		Profile     string   `json:"profile,omitempty"`
+	}{
+		Identifiers: []wireID{{Type: "dns", Value: domain}},
+		Replaces:    opts.replaces,
+		Profile:     opts.profile,
+	}
+	res, err := m.postJWS(ctx, client, dir.NonceURL, dir.OrderURL, req)
+	if err != nil {
+		if ae, ok := err.(*acme.Error); ok && ae.ProblemType == errAlreadyReplaced {
+			// Another order already took over the old cert.
+			opts.replaces = ""
+			return m.authorizeOrder(ctx, client, domain, opts)
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("acme/autocert: new order returned %s", res.Status)
+	}
+	return decodeOrder(res)
+}
+
+// decodeOrder parses an order object from a CA response.
+func decodeOrder(res *http.Response) (*acme.Order, error) {
+	var v struct {
+		Status      string
+		Expires     time.Time
+		Identifiers []struct {
+			Type  string
+			Value string
+		}
+		NotBefore      time.Time
+		NotAfter       time.Time
+		Authorizations []string
+		Finalize       string
+		Certificate    string
+		Error          *struct {
+			Type     string
+			Detail   string
+			Instance string
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("acme/autocert: invalid order response: %v", err)
+	}
+	o := &acme.Order{
+		URI:         res.Header.Get("Location"),
+		Status:      v.Status,
+		Expires:     v.Expires,
+		NotBefore:   v.NotBefore,
+		NotAfter:    v.NotAfter,
+		AuthzURLs:   v.Authorizations,
+		FinalizeURL: v.Finalize,
+		CertURL:     v.Certificate,
+	}
+	for _, id := range v.Identifiers {
+		o.Identifiers = append(o.Identifiers, acme.AuthzID{Type: id.Type, Value: id.Value})
+	}
+	if v.Error != nil {
+		o.Error = &acme.Error{ProblemType: v.Error.Type, Detail: v.Error.Detail, Instance: v.Error.Instance}
+	}
+	return o, nil
+}
+
+// postJWS sends payload to url as a JWS signed with client's account key,
+// retrying once if the CA rejects the nonce.
+// Responses with a status code of 400 or above are returned as *acme.Error.
+func (m *Manager) postJWS(ctx context.Context, client *acme.Client, nonceURL, url string, payload interface{}) (*http.Response, error) {
+	kid, err := accountURI(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := m.fetchNonce(ctx, nonceURL)
+	if err != nil {
+		return nil, err
+	}
+	for retried := false; ; retried = true {
+		b, err := jwsEncode(client.Key, kid, nonce, url, body)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		if client.UserAgent != "" {
+			req.Header.Set("User-Agent", client.UserAgent)
+		}
+		res, err := m.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+		ae := responseError(res)
+		res.Body.Close()
+		if !retried && ae.ProblemType == "urn:ietf:params:acme:error:badNonce" {
+			if nonce = res.Header.Get("Replay-Nonce"); nonce == "" {
+				if nonce, err = m.fetchNonce(ctx, nonceURL); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		return nil, ae
+	}
+}
+
+// AccountURI returns the URI of the ACME account the Manager uses, registering
+// the account first if needed. CAA records can restrict issuance to the
+// account with it, see RFC 8657.
+func (m *Manager) AccountURI(ctx context.Context) (string, error) {
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return accountURI(ctx, client)
+}
+
+// accountURI returns the URI of the account registered by client,
+// which the CA also uses as the key ID in signed requests.
+func accountURI(ctx context.Context, client *acme.Client) (string, error) {
+	if client.KID != "" {
+		return string(client.KID), nil
+	}
+	a, err := client.GetReg(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	return a.URI, nil
+}
+
+func (m *Manager) fetchNonce(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := m.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme/autocert: nonce not returned")
+	}
+	return nonce, nil
+}
+
+// responseError turns an error response from the CA into an *acme.Error.
+func responseError(res *http.Response) *acme.Error {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	var v struct {
+		Type     string
+		Detail   string
+		Instance string
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		v.Detail = string(b)
+	}
+	return &acme.Error{
+		StatusCode:  res.StatusCode,
+		ProblemType: v.Type,
+		Detail:      v.Detail,
+		Instance:    v.Instance,
+		Header:      res.Header,
+	}
+}
+
+// jwsEncode signs payload with key as a flattened JWS in the form
+// the ACME protocol requires for requests by an existing account.
+func jwsEncode(key crypto.Signer, kid, nonce, url string, payload []byte) ([]byte, error) {
+	alg, hash, err := jwsAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	phead, err := json.Marshal(struct {
+		Alg   string `json:"alg"`
+		KID   string `json:"kid"`
+		Nonce string `json:"nonce"`
+		URL   string `json:"url"`
+	}{alg, kid, nonce, url})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	protected := enc.EncodeToString(phead)
+	body := enc.EncodeToString(payload)
+
+	h := hash.New()
+	io.WriteString(h, protected+"."+body)
+	sig, err := jwsSign(key, hash, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{protected, body, enc.EncodeToString(sig)})
+}
+
+// jwsAlgorithm returns the JWS algorithm name and hash for key.
+func jwsAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return "ES256", crypto.SHA256, nil
+		case 384:
+			return "ES384", crypto.SHA384, nil
+		case 521:
+			return "ES512", crypto.SHA512, nil
+		}
+	}
+	return "", 0, errors.New("acme/autocert: unsupported account key type")
+}
+
+// jwsSign signs digest with key. ECDSA signatures are converted from ASN.1
+// to the fixed size concatenation of r and s required by JWS.
+func jwsSign(key crypto.Signer, hash crypto.Hash, digest []byte) ([]byte, error) {
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return sig, nil
+	}
+	var v struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &v); err != nil {
+		return nil, err
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	rb, sb := v.R.Bytes(), v.S.Bytes()
+	out := make([]byte, 2*size)
+	copy(out[size-len(rb):size], rb)
+	copy(out[2*size-len(sb):], sb)
+	return out, nil
+}
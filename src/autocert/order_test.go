@@ -0,0 +1,121 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestOrderOptions(t *testing.T) {
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"renewalInfo": %q,
+			"meta": {"profiles": {"classic": "The default", "shortlived": "Six days"}}
+		}`, ca.URL+"/ari")
+	}))
+	defer ca.Close()
+
+	tt := []struct {
+		profile  string
+		replaces *x509.Certificate
+		want     orderOptions
+	}{
+		{"", nil, orderOptions{}},
+		{"shortlived", nil, orderOptions{profile: "shortlived"}},
+		{"unknown", nil, orderOptions{}},
+		{"classic", ariTestLeaf(), orderOptions{replaces: "AQID.Kg", profile: "classic"}},
+	}
+	for _, test := range tt {
+		man := &Manager{
+			Client:  &acme.Client{DirectoryURL: ca.URL},
+			Profile: test.profile,
+		}
+		opts := man.orderOptions(context.Background(), test.replaces)
+		if opts != test.want {
+			t.Errorf("orderOptions(%q) = %+v; want %+v", test.profile, opts, test.want)
+		}
+	}
+}
+
+func TestChainIssuedBy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ISRG Root X1"},
+		Issuer:       pkix.Name{CommonName: "DST Root CA X3"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent := &x509.Certificate{Subject: pkix.Name{CommonName: "DST Root CA X3"}}
+	cross, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := dummyCert(nil, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := [][]byte{leaf, cross}
+	if !chainIssuedBy(chain, "DST Root CA X3") {
+		t.Error("chainIssuedBy(DST Root CA X3) = false; want true")
+	}
+	if chainIssuedBy(chain, "ISRG Root X1") {
+		t.Error("chainIssuedBy(ISRG Root X1) = true; want false")
+	}
+	if chainIssuedBy(nil, "DST Root CA X3") {
+		t.Error("chainIssuedBy of empty chain = true; want false")
+	}
+}
+
+func TestAccountURI(t *testing.T) {
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`,
+				ca.URL+"/nonce", ca.URL+"/new-account", ca.URL+"/new-order")
+		case "/nonce":
+		case "/new-account":
+			w.Header().Set("Location", ca.URL+"/acct/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"status": "valid"}`)
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer ca.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := &Manager{Client: &acme.Client{DirectoryURL: ca.URL, Key: key}, Prompt: AcceptTOS}
+	uri, err := man.AccountURI(context.Background())
+	if err != nil {
+		t.Fatalf("AccountURI: %v", err)
+	}
+	if want := ca.URL + "/acct/1"; uri != want {
+		t.Errorf("AccountURI = %q; want %q", uri, want)
+	}
+}
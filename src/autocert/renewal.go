@@ -5,8 +5,10 @@
 package autocert
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"crypto/x509"
 	"sync"
 	"time"
 )
@@ -23,19 +25,33 @@ type domainRenewal struct {
 
 	timerMu sync.Mutex
 	timer   *time.Timer
+
+	// ariStart and ariEnd are the last renewal window suggested by the CA,
+	// and ariAt the randomly chosen renewal time within it.
+	// They are guarded by timerMu.
+	ariStart, ariEnd, ariAt time.Time
+
+	ocspMu    sync.Mutex
+	ocspTimer *time.Timer // refreshes the OCSP staple; see refreshOCSP
 }
 
 // start starts a cert renewal timer at the time
-// defined by the certificate expiration time exp.
+// defined by the validity period of the certificate leaf.
 //
 // If the timer is already started, calling start is a noop.
-func (dr *domainRenewal) start(exp time.Time) {
+func (dr *domainRenewal) start(leaf *x509.Certificate) {
 	dr.timerMu.Lock()
 	defer dr.timerMu.Unlock()
 	if dr.timer != nil {
 		return
 	}
-	dr.timer = time.AfterFunc(dr.next(exp), dr.renew)
+	next := dr.next(leaf)
+	if dr.m.supportsARI() && next > ariDefaultRetry {
+		// Check the CA's renewal information early,
+		// in case it suggests renewing before the regular schedule.
+		next = ariDefaultRetry
+	}
+	dr.timer = time.AfterFunc(next, dr.renew)
 }
 
 // stop stops the cert renewal timer.
@@ -48,6 +64,7 @@ func (dr *domainRenewal) stop() {
 	}
 	dr.timer.Stop()
 	dr.timer = nil
+	dr.stopOCSP()
 }
 
 // renew is called periodically by a timer.
@@ -58,6 +75,14 @@ func (dr *domainRenewal) renew() {
 	if dr.timer == nil {
 		return
 	}
+	if dr.m.idle(dr.ck) {
+		// Nobody has asked for the cert in a while: let it expire.
+		// forgetRenewal takes renewalMu, which is acquired before timerMu elsewhere.
+		dr.timer = nil
+		dr.stopOCSP()
+		go dr.m.forgetRenewal(dr)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
@@ -72,12 +97,34 @@ func (dr *domainRenewal) renew() {
 }
 
 // updateState locks and replaces the relevant Manager.state item with the given
-// state. It additionally updates dr.key with the given state's key.
+// state. It additionally updates dr.key with the given state's key
+// and fetches an OCSP staple for the new cert. If the cert is the one
+// already in use, its staple is carried over and the OCSP timer left as is.
 func (dr *domainRenewal) updateState(state *certState) {
 	dr.m.stateMu.Lock()
-	defer dr.m.stateMu.Unlock()
+	prev := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	// prev may be locked while its cert is being created;
+	// don't wait for it while holding stateMu.
+	sameLeaf := false
+	if prev != nil && state.leaf != nil {
+		prev.RLock()
+		if prev.leaf != nil && bytes.Equal(prev.leaf.Raw, state.leaf.Raw) {
+			state.ocsp = prev.ocsp
+			sameLeaf = true
+		}
+		prev.RUnlock()
+	}
+
+	dr.m.stateMu.Lock()
 	dr.key = state.key
 	dr.m.state[dr.ck] = state
+	dr.m.stateMu.Unlock()
+	if sameLeaf {
+		return
+	}
+	// refreshOCSP takes stateMu after ocspMu.
+	dr.startOCSP()
 }
 
 // do is similar to Manager.createCert but it doesn't lock a Manager.state item.
@@ -85,15 +132,23 @@ func (dr *domainRenewal) updateState(state *certState) {
 // replaces dr.m.state item with a new one and updates cache for the given domain.
 //
 // It may lock and update the Manager.state if the expiration date of the currently
-// cached cert is far enough in the future.
+// cached cert is far enough in the future, or if the CA's renewal information
+// says it is not yet time to renew.
 //
 // The returned value is a time interval after which the renewal should occur again.
 func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 	// a race is likely unavoidable in a distributed environment
 	// but we try nonetheless
+	replaces := dr.leaf()
 	if tlscert, err := dr.m.cacheGet(ctx, dr.ck); err == nil {
-		next := dr.next(tlscert.Leaf.NotAfter)
-		if next > dr.m.renewBefore()+renewJitter {
+		replaces = tlscert.Leaf
+		next, ok := dr.nextARI(ctx, tlscert.Leaf)
+		fresh := next > 0
+		if !ok {
+			next = dr.next(tlscert.Leaf)
+			fresh = next > dr.m.renewBefore(tlscert.Leaf)+renewJitter
+		}
+		if fresh {
 			signer, ok := tlscert.PrivateKey.(crypto.Signer)
 			if ok {
 				state := &certState{
@@ -105,9 +160,15 @@ func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 				return next, nil
 			}
 		}
+	} else if replaces != nil {
+		// Without a cache, the CA's renewal information is the only
+		// reason not to renew right away.
+		if next, ok := dr.nextARI(ctx, replaces); ok && next > 0 {
+			return next, nil
+		}
 	}
 
-	der, leaf, err := dr.m.authorizedCert(ctx, dr.key, dr.ck)
+	der, leaf, err := dr.m.authorizedCert(ctx, dr.key, dr.ck, replaces)
 	if err != nil {
 		return 0, err
 	}
@@ -124,11 +185,65 @@ func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 		return 0, err
 	}
 	dr.updateState(state)
-	return dr.next(leaf.NotAfter), nil
+	if next, ok := dr.nextARI(ctx, leaf); ok {
+		return next, nil
+	}
+	return dr.next(leaf), nil
+}
+
+// leaf returns the leaf of the cert currently held in Manager.state, if any.
+func (dr *domainRenewal) leaf() *x509.Certificate {
+	dr.m.stateMu.Lock()
+	defer dr.m.stateMu.Unlock()
+	if s, ok := dr.m.state[dr.ck]; ok {
+		return s.leaf
+	}
+	return nil
+}
+
+// nextARI returns the time interval after which leaf should be renewed
+// according to the CA's renewal information (ARI), capped at the interval
+// after which the CA wants the information to be fetched again.
+// Zero means the cert should be renewed right away.
+//
+// It reports false if the CA does not provide renewal information for leaf,
+// in which case the regular schedule of dr.next applies. If the information
+// is only temporarily unavailable, the regular schedule is used but the CA
+// is asked again after the default polling interval.
+func (dr *domainRenewal) nextARI(ctx context.Context, leaf *x509.Certificate) (time.Duration, bool) {
+	info, err := dr.m.renewalInfo(ctx, leaf)
+	if err == errNoRenewalInfo {
+		return 0, false
+	}
+	if err != nil {
+		next := dr.next(leaf)
+		if next > ariDefaultRetry {
+			next = ariDefaultRetry
+		}
+		return next, true
+	}
+
+	// Stick to the renewal time picked earlier for the same window,
+	// so that polling doesn't skew it towards the window start.
+	if !info.start.Equal(dr.ariStart) || !info.end.Equal(dr.ariEnd) {
+		dr.ariStart, dr.ariEnd = info.start, info.end
+		n := pseudoRand.int63n(int64(info.end.Sub(info.start)))
+		dr.ariAt = info.start.Add(time.Duration(n))
+	}
+	next := dr.ariAt.Sub(dr.m.now())
+	if next < 0 {
+		return 0, true
+	}
+	if next > info.retryAfter {
+		next = info.retryAfter
+	}
+	return next, true
 }
 
-func (dr *domainRenewal) next(expiry time.Time) time.Duration {
-	d := expiry.Sub(dr.m.now()) - dr.m.renewBefore()
+// next returns the time interval after which leaf should be renewed
+// on the regular schedule.
+func (dr *domainRenewal) next(leaf *x509.Certificate) time.Duration {
+	d := leaf.NotAfter.Sub(dr.m.now()) - dr.m.renewBefore(leaf)
 	// add a bit of randomness to renew deadline
 	n := pseudoRand.int63n(int64(renewJitter))
 	d -= time.Duration(n)
@@ -40,7 +40,31 @@ func TestRenewalNext(t *testing.T) {
 
 	dr := &domainRenewal{m: man}
 	for i, test := range tt {
-		next := dr.next(test.expiry)
+		leaf := &x509.Certificate{NotBefore: test.expiry.Add(-90 * 24 * time.Hour), NotAfter: test.expiry}
+		next := dr.next(leaf)
+		if next < test.min || test.max < next {
+			t.Errorf("%d: next = %v; want between %v and %v", i, next, test.min, test.max)
+		}
+	}
+}
+
+func TestRenewalNextShortLived(t *testing.T) {
+	now := time.Now()
+	man := &Manager{nowFunc: func() time.Time { return now }}
+	defer man.stopRenew()
+	tt := []struct {
+		notBefore, notAfter time.Time
+		min, max            time.Duration
+	}{
+		// A fresh 6-day cert lasts 4 days despite the default RenewBefore of 30 days
+		{now, now.Add(6 * 24 * time.Hour), 96*time.Hour - renewJitter, 96 * time.Hour},
+		{now.Add(-3 * 24 * time.Hour), now.Add(3 * 24 * time.Hour), 24*time.Hour - renewJitter, 24 * time.Hour},
+		{now.Add(-5 * 24 * time.Hour), now.Add(24 * time.Hour), 0, 1},
+	}
+
+	dr := &domainRenewal{m: man}
+	for i, test := range tt {
+		next := dr.next(&x509.Certificate{NotBefore: test.notBefore, NotAfter: test.notAfter})
 		if next < test.min || test.max < next {
 			t.Errorf("%d: next = %v; want between %v and %v", i, next, test.min, test.max)
 		}
@@ -312,7 +336,7 @@ func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 	}
 
 	// trigger renew
-	go man.renew(exampleCertKey, s.key, s.leaf.NotAfter)
+	go man.renew(exampleCertKey, s.key, s.leaf)
 
 	// wait for renew loop
 	select {
@@ -330,3 +354,198 @@ func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCertKey(t *testing.T) {
+	tt := []struct {
+		key string
+		ck  certKey
+		ok  bool
+	}{
+		{"example.org", certKey{domain: "example.org"}, true},
+		{"example.org+rsa", certKey{domain: "example.org", isRSA: true}, true},
+		{"example.org+token", certKey{}, false},
+		{"acme_account+key", certKey{}, false},
+		{"token+http-01", certKey{}, false},
+		{"", certKey{}, false},
+	}
+	for _, test := range tt {
+		ck, ok := parseCertKey(test.key)
+		if ck != test.ck || ok != test.ok {
+			t.Errorf("parseCertKey(%q) = %v, %v; want %v, %v", test.key, ck, ok, test.ck, test.ok)
+		}
+	}
+}
+
+func TestRenewCached(t *testing.T) {
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: "invalid",
+		},
+	}
+	defer man.stopRenew()
+
+	// cache a valid cert and some non-cert entries
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := dummyCert(key.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	ctx := context.Background()
+	if err := man.cachePut(ctx, exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+	if err := man.Cache.Put(ctx, "acme_account+key", []byte("junk")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := man.RenewCached(ctx); err != nil {
+		t.Fatalf("man.RenewCached: %v", err)
+	}
+
+	// renewal timers are started asynchronously
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		man.renewalMu.Lock()
+		n, ok := len(man.renewal), man.renewal[exampleCertKey] != nil
+		man.renewalMu.Unlock()
+		if n == 1 && ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("man.renewal has %d entries; want only %q", n, exampleCertKey)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRenewCachedNotRequested(t *testing.T) {
+	now := time.Now()
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		RenewIdle:   time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: "invalid",
+		},
+		nowFunc: func() time.Time { return now },
+	}
+	defer man.stopRenew()
+
+	// cache a cert issued two hours ago
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := dateDummyCert(key.Public(), now.Add(-2*time.Hour), now.Add(90*24*time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	ctx := context.Background()
+	if err := man.cachePut(ctx, exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := man.RenewCached(ctx); err != nil {
+		t.Fatalf("man.RenewCached: %v", err)
+	}
+	man.stateMu.Lock()
+	s, ok := man.state[exampleCertKey]
+	used := man.used[exampleCertKey]
+	man.stateMu.Unlock()
+	if !ok {
+		t.Fatalf("cert not loaded into man.state")
+	}
+	// loading it is not a request, so the cert is already idle
+	if !used.Equal(s.leaf.NotBefore) {
+		t.Errorf("man.used = %v; want the issue time %v", used, s.leaf.NotBefore)
+	}
+	if !man.idle(exampleCertKey) {
+		t.Errorf("man.idle = false for a cert not requested since its issuance")
+	}
+
+	// a request makes it no longer idle
+	if _, err := man.cert(ctx, exampleCertKey); err != nil {
+		t.Fatal(err)
+	}
+	if man.idle(exampleCertKey) {
+		t.Errorf("man.idle = true for a cert just requested")
+	}
+
+	// and loading it again does not undo the request
+	if err := man.RenewCached(ctx); err != nil {
+		t.Fatalf("man.RenewCached: %v", err)
+	}
+	man.stateMu.Lock()
+	used = man.used[exampleCertKey]
+	man.stateMu.Unlock()
+	if !used.Equal(now) {
+		t.Errorf("man.used = %v after a request; want %v", used, now)
+	}
+}
+
+func TestRenewCachedNoLister(t *testing.T) {
+	man := &Manager{Cache: cacheGetFunc(nil)}
+	if err := man.RenewCached(context.Background()); err == nil {
+		t.Error("man.RenewCached: want error for a cache without List")
+	}
+}
+
+func TestRenewIdle(t *testing.T) {
+	now := time.Now()
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		RenewBefore: 24 * time.Hour,
+		RenewIdle:   time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: "invalid",
+		},
+		nowFunc: func() time.Time { return now },
+	}
+	defer man.stopRenew()
+
+	// cert last requested two hours ago
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man.stateMu.Lock()
+	man.state = map[certKey]*certState{exampleCertKey: {key: key}}
+	man.used = map[certKey]time.Time{exampleCertKey: now.Add(-2 * time.Hour)}
+	man.stateMu.Unlock()
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	testDidRenewLoop = func(next time.Duration, err error) {
+		t.Errorf("testDidRenewLoop called for an idle cert")
+	}
+
+	// the cert is expired, so the renewal timer fires right away;
+	// renewal and state are then dropped asynchronously
+	man.renew(exampleCertKey, key, &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		man.renewalMu.Lock()
+		_, running := man.renewal[exampleCertKey]
+		man.renewalMu.Unlock()
+		man.stateMu.Lock()
+		_, inState := man.state[exampleCertKey]
+		man.stateMu.Unlock()
+		if !running && !inState {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle cert still tracked: renewal %v, state %v", running, inState)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Wait between attempts to fetch the ACME account, e.g. while the CA is down
+	caaRetry = time.Minute
+	// Check the records this often, in case they were changed through the API
+	caaRefresh = time.Hour
+)
+
+// getCAAValues returns the CAA records for the account in the form stored in
+// the database
+func getCAAValues(accountURI string, config certConfig) []string {
+	issuer := config.CAAIssuer + "; accounturi=" + accountURI
+	records := []*dns.CAA{
+		{Tag: "issue", Value: issuer},
+		{Tag: "issuewild", Value: issuer},
+	}
+	if config.CAAIodef != "" {
+		records = append(records, &dns.CAA{Tag: "iodef", Value: config.CAAIodef})
+	}
+
+	var values []string
+	for _, rr := range records {
+		rr.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+		values = append(values, strings.TrimPrefix(rr.String(), rr.Hdr.String()))
+	}
+	return values
+}
+
+// isPublishedCAA tells whether the stored CAA value is one published by the
+// server, possibly for an earlier account
+func isPublishedCAA(value string, config certConfig) bool {
+	rr, err := dns.NewRR(". IN CAA " + value)
+	if err != nil || rr == nil {
+		return false
+	}
+	caa := rr.(*dns.CAA)
+	switch caa.Tag {
+	case "issue", "issuewild":
+		return strings.HasPrefix(caa.Value, config.CAAIssuer+"; accounturi=")
+	case "iodef":
+		return config.CAAIodef != ""
+	}
+	return false
+}
+
+// publishCAA stores CAA records at the zone apex domain, which allow only the
+// configured CA to issue certificates, and only to the ACME account of the
+// server (RFC 8657). The other CAA records of the apex are kept. It fetches
+// the account URI, registering the account if needed, and checks the records
+// again every caaRefresh. It never returns.
+func publishCAA(db Database, domain string, getAccountURI func(context.Context) (string, error), config certConfig) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		uri, err := getAccountURI(ctx)
+		if err == nil {
+			err = putCAAValues(ctx, db, domain, getCAAValues(uri, config), config)
+		}
+		cancel()
+		wait := caaRefresh
+		if err != nil {
+			fmt.Printf("Publishing CAA records failed with error: %v\n", err)
+			wait = caaRetry
+		}
+		time.Sleep(wait)
+	}
+}
+
+// putCAAValues replaces the CAA records published earlier with values. The
+// zone serial number only changes if the records do.
+func putCAAValues(ctx context.Context, db Database, domain string, values []string, config certConfig) error {
+	original, err := db.GetRecords(ctx, domain, dns.TypeCAA)
+	if err != nil {
+		return err
+	}
+	updated := append([]string(nil), values...)
+	for _, value := range original {
+		if !isPublishedCAA(value, config) {
+			updated = append(updated, value)
+		}
+	}
+	return db.PutRecords(ctx, domain, dns.TypeCAA, updated)
+}
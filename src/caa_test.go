@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetCAAValues(t *testing.T) {
+	const uri = "https://acme.example.com/acct/1"
+	tests := []struct {
+		config certConfig
+		values []string
+	}{
+		{certConfig{CAAIssuer: "letsencrypt.org"}, []string{
+			`0 issue "letsencrypt.org; accounturi=` + uri + `"`,
+			`0 issuewild "letsencrypt.org; accounturi=` + uri + `"`,
+		}},
+		{certConfig{CAAIssuer: "letsencrypt.org", CAAIodef: "mailto:admin@example.org"}, []string{
+			`0 issue "letsencrypt.org; accounturi=` + uri + `"`,
+			`0 issuewild "letsencrypt.org; accounturi=` + uri + `"`,
+			`0 iodef "mailto:admin@example.org"`,
+		}},
+	}
+	for _, tt := range tests {
+		values := getCAAValues(uri, tt.config)
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("getCAAValues(%+v) = %q; want %q", tt.config, values, tt.values)
+		}
+		for _, value := range values {
+			if _, err := getRecordValue(dns.TypeCAA, value); err != nil {
+				t.Errorf("%q is not a valid CAA record: %v", value, err)
+			}
+			if !isPublishedCAA(value, tt.config) {
+				t.Errorf("isPublishedCAA(%q) = false", value)
+			}
+		}
+	}
+}
+
+func TestPutCAAValues(t *testing.T) {
+	config := certConfig{CAAIssuer: "letsencrypt.org", CAAIodef: "mailto:admin@example.org"}
+	db := &serialDatabase{Database: &MemoryDatabase{}, zone: "example.org"}
+	ctx := context.Background()
+	// Records added by hand are kept
+	other := []string{`0 issue "pki.example.net"`, `0 issue "letsencrypt.org"`}
+	if err := db.PutRecords(ctx, "example.org", dns.TypeCAA, other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		uri    string
+		serial bool // whether the serial number changes
+	}{
+		{"publish", "https://acme.example.com/acct/1", true},
+		{"unchanged", "https://acme.example.com/acct/1", false},
+		{"new account", "https://acme.example.com/acct/2", true},
+	}
+	for _, tt := range tests {
+		serial, err := db.GetSerial(ctx, "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := getCAAValues(tt.uri, config)
+		if err := putCAAValues(ctx, db, "example.org", values, config); err != nil {
+			t.Fatalf("%s: putCAAValues failed: %v", tt.name, err)
+		}
+
+		stored, err := db.GetRecords(ctx, "example.org", dns.TypeCAA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append(values, other...); !reflect.DeepEqual(stored, want) {
+			t.Errorf("%s: records = %q; want %q", tt.name, stored, want)
+		}
+		updated, err := db.GetSerial(ctx, "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (updated != serial) != tt.serial {
+			t.Errorf("%s: serial changed from %d to %d", tt.name, serial, updated)
+		}
+	}
+}
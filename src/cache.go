@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Bound the memory used by (negative) entries for queries of random names
+const maxCachedNames = 100000
+
+// cachedDatabase wraps a Database and keeps the zone in memory, so that the
+// DNS hot path rarely touches the backend. The cache is write-through: it
+// relies on all changes to the zone going through it. Names without records
+// are cached too.
+//
+// Certificates are passed through uncached.
+type cachedDatabase struct {
+	Database
+
+	mu      sync.RWMutex
+	gen     uint64 // incremented on every change to the zone
+	exists  map[string]bool
+	ipaddrs map[string][]net.IP
+	viewips map[string]map[string][]net.IP // by view, then domain
+	txtvals map[string][]string
+	records map[string]map[uint16][]string
+	serials map[string]uint32
+}
+
+// generation returns the current generation, to be compared before caching
+// what was read from the backend: results read while the zone changed are
+// dropped, as they may be outdated.
+func (db *cachedDatabase) generation() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.gen
+}
+
+// write calls f to change records of domain in the backend, then drops
+// everything cached about domain. Readers may see the old records until f
+// has returned, but the database doesn't guarantee otherwise either.
+func (db *cachedDatabase) write(domain string, f func() error) error {
+	err := f()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.gen++
+	delete(db.ipaddrs, domain)
+	for _, ipaddrs := range db.viewips {
+		delete(ipaddrs, domain)
+	}
+	delete(db.txtvals, domain)
+	delete(db.records, domain)
+	// Any change may turn ancestors into or from empty non-terminals
+	db.exists = nil
+	db.serials = nil
+	return err
+}
+
+func (db *cachedDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	db.mu.RLock()
+	exists, ok := db.exists[domain]
+	db.mu.RUnlock()
+	if ok {
+		return exists, nil
+	}
+
+	gen := db.generation()
+	exists, err := db.Database.DoesDomainExist(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.exists == nil || len(db.exists) >= maxCachedNames {
+			db.exists = make(map[string]bool)
+		}
+		db.exists[domain] = exists
+	}
+	return exists, nil
+}
+
+func (db *cachedDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	db.mu.RLock()
+	addresses, ok := db.ipaddrs[domain]
+	db.mu.RUnlock()
+	if ok {
+		return addresses, nil
+	}
+
+	gen := db.generation()
+	addresses, err := db.Database.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.ipaddrs == nil || len(db.ipaddrs) >= maxCachedNames {
+			db.ipaddrs = make(map[string][]net.IP)
+		}
+		db.ipaddrs[domain] = addresses
+	}
+	return addresses, nil
+}
+
+func (db *cachedDatabase) PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error {
+	return db.write(domain, func() error {
+		return db.Database.PutIPAddresses(ctx, domain, addresses)
+	})
+}
+
+func (db *cachedDatabase) DeleteIPAddresses(ctx context.Context, domain string) error {
+	return db.write(domain, func() error {
+		return db.Database.DeleteIPAddresses(ctx, domain)
+	})
+}
+
+func (db *cachedDatabase) GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error) {
+	db.mu.RLock()
+	addresses, ok := db.viewips[view][domain]
+	db.mu.RUnlock()
+	if ok {
+		return addresses, nil
+	}
+
+	gen := db.generation()
+	addresses, err := db.Database.GetViewAddresses(ctx, domain, view)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.viewips[view] == nil || len(db.viewips[view]) >= maxCachedNames {
+			if db.viewips == nil {
+				db.viewips = make(map[string]map[string][]net.IP)
+			}
+			db.viewips[view] = make(map[string][]net.IP)
+		}
+		db.viewips[view][domain] = addresses
+	}
+	return addresses, nil
+}
+
+func (db *cachedDatabase) PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error {
+	return db.write(domain, func() error {
+		return db.Database.PutViewAddresses(ctx, domain, view, addresses)
+	})
+}
+
+func (db *cachedDatabase) DeleteViewAddresses(ctx context.Context, domain, view string) error {
+	return db.write(domain, func() error {
+		return db.Database.DeleteViewAddresses(ctx, domain, view)
+	})
+}
+
+func (db *cachedDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
+	db.mu.RLock()
+	values, ok := db.txtvals[domain]
+	db.mu.RUnlock()
+	if ok {
+		return values, nil
+	}
+
+	gen := db.generation()
+	values, err := db.Database.GetTXTValues(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.txtvals == nil || len(db.txtvals) >= maxCachedNames {
+			db.txtvals = make(map[string][]string)
+		}
+		db.txtvals[domain] = values
+	}
+	return values, nil
+}
+
+func (db *cachedDatabase) PutTXTValues(ctx context.Context, domain string, values []string) error {
+	return db.write(domain, func() error {
+		return db.Database.PutTXTValues(ctx, domain, values)
+	})
+}
+
+func (db *cachedDatabase) DeleteTXTValues(ctx context.Context, domain string) error {
+	return db.write(domain, func() error {
+		return db.Database.DeleteTXTValues(ctx, domain)
+	})
+}
+
+func (db *cachedDatabase) GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error) {
+	db.mu.RLock()
+	values, ok := db.records[domain][rrtype]
+	db.mu.RUnlock()
+	if ok {
+		return values, nil
+	}
+
+	gen := db.generation()
+	values, err := db.Database.GetRecords(ctx, domain, rrtype)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.records == nil || len(db.records) >= maxCachedNames {
+			db.records = make(map[string]map[uint16][]string)
+		}
+		if db.records[domain] == nil {
+			db.records[domain] = make(map[uint16][]string)
+		}
+		db.records[domain][rrtype] = values
+	}
+	return values, nil
+}
+
+func (db *cachedDatabase) PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error {
+	return db.write(domain, func() error {
+		return db.Database.PutRecords(ctx, domain, rrtype, values)
+	})
+}
+
+func (db *cachedDatabase) DeleteRecords(ctx context.Context, domain string, rrtype uint16) error {
+	return db.write(domain, func() error {
+		return db.Database.DeleteRecords(ctx, domain, rrtype)
+	})
+}
+
+func (db *cachedDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	db.mu.RLock()
+	serial, ok := db.serials[zone]
+	db.mu.RUnlock()
+	if ok {
+		return serial, nil
+	}
+
+	gen := db.generation()
+	serial, err := db.Database.GetSerial(ctx, zone)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.gen == gen {
+		if db.serials == nil {
+			db.serials = make(map[string]uint32)
+		}
+		db.serials[zone] = serial
+	}
+	return serial, nil
+}
+
+func (db *cachedDatabase) PutSerial(ctx context.Context, zone string, serial uint32) error {
+	return db.write("", func() error {
+		return db.Database.PutSerial(ctx, zone, serial)
+	})
+}
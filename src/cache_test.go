@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// countingDatabase counts the reads reaching the wrapped Database
+type countingDatabase struct {
+	Database
+	reads int
+}
+
+func (db *countingDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	db.reads++
+	return db.Database.DoesDomainExist(ctx, domain)
+}
+
+func (db *countingDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	db.reads++
+	return db.Database.GetIPAddresses(ctx, domain)
+}
+
+func (db *countingDatabase) GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error) {
+	db.reads++
+	return db.Database.GetViewAddresses(ctx, domain, view)
+}
+
+func (db *countingDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
+	db.reads++
+	return db.Database.GetTXTValues(ctx, domain)
+}
+
+func (db *countingDatabase) GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error) {
+	db.reads++
+	return db.Database.GetRecords(ctx, domain, rrtype)
+}
+
+func (db *countingDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	db.reads++
+	return db.Database.GetSerial(ctx, zone)
+}
+
+func TestCachedDatabase(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingDatabase{Database: &MemoryDatabase{}}
+	db := &cachedDatabase{Database: backend}
+	ip1 := []net.IP{net.ParseIP("192.0.2.1")}
+	ip2 := []net.IP{net.ParseIP("192.0.2.2")}
+
+	get := func(f func() (interface{}, error)) func() string {
+		return func() string {
+			v, err := f()
+			if err != nil {
+				return err.Error()
+			}
+			return fmt.Sprint(v)
+		}
+	}
+	getIPs := get(func() (interface{}, error) { return db.GetIPAddresses(ctx, "a.example.org") })
+	getViewIPs := get(func() (interface{}, error) { return db.GetViewAddresses(ctx, "a.example.org", "lan") })
+	getTXT := get(func() (interface{}, error) { return db.GetTXTValues(ctx, "a.example.org") })
+	getMX := get(func() (interface{}, error) { return db.GetRecords(ctx, "a.example.org", dns.TypeMX) })
+	exists := get(func() (interface{}, error) { return db.DoesDomainExist(ctx, "b.example.org") })
+	getSerial := get(func() (interface{}, error) { return db.GetSerial(ctx, "example.org") })
+	put := func(f func() error) func() string {
+		return func() string {
+			if err := f(); err != nil {
+				return err.Error()
+			}
+			return ""
+		}
+	}
+
+	tests := []struct {
+		name string
+		op   func() string
+		want string
+		// Whether the backend is read
+		read bool
+	}{
+		{"addresses", getIPs, "[]", true},
+		{"cached addresses", getIPs, "[]", false},
+		{"put addresses", put(func() error { return db.PutIPAddresses(ctx, "a.example.org", ip1) }), "", false},
+		{"new addresses", getIPs, "[192.0.2.1]", true},
+		{"cached new addresses", getIPs, "[192.0.2.1]", false},
+		{"view addresses", getViewIPs, "[]", true},
+		{"put view addresses", put(func() error { return db.PutViewAddresses(ctx, "a.example.org", "lan", ip2) }), "", false},
+		{"new view addresses", getViewIPs, "[192.0.2.2]", true},
+		{"addresses after view change", getIPs, "[192.0.2.1]", true},
+		{"TXT", getTXT, "[]", true},
+		{"put TXT", put(func() error { return db.PutTXTValues(ctx, "a.example.org", []string{`"v"`}) }), "", false},
+		{"new TXT", getTXT, `["v"]`, true},
+		{"cached TXT", getTXT, `["v"]`, false},
+		{"MX", getMX, "[]", true},
+		{"put MX", put(func() error {
+			return db.PutRecords(ctx, "a.example.org", dns.TypeMX, []string{"10 mail.example.org."})
+		}), "", false},
+		{"new MX", getMX, "[10 mail.example.org.]", true},
+		{"cached MX", getMX, "[10 mail.example.org.]", false},
+		{"missing name", exists, "false", true},
+		{"cached missing name", exists, "false", false},
+		{"put missing name", put(func() error { return db.PutIPAddresses(ctx, "b.example.org", ip1) }), "", false},
+		{"new name", exists, "true", true},
+		{"serial", getSerial, "0", true},
+		{"cached serial", getSerial, "0", false},
+		{"put serial", put(func() error { return db.PutSerial(ctx, "example.org", 7) }), "", false},
+		{"new serial", getSerial, "7", true},
+		{"cached new serial", getSerial, "7", false},
+	}
+	for _, tt := range tests {
+		reads := backend.reads
+		if got := tt.op(); got != tt.want {
+			t.Errorf("%s = %q; want %q", tt.name, got, tt.want)
+		}
+		if read := backend.reads != reads; read != tt.read {
+			t.Errorf("%s: backend read = %v; want %v", tt.name, read, tt.read)
+		}
+	}
+}
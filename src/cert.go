@@ -41,10 +41,15 @@ func getPrivateKey(tlscert *tls.Certificate) (string, error) {
 	return string(buf.Bytes()), nil
 }
 
-func getCertificates(tlscert *tls.Certificate) (string, error) {
+func getCertificates(tlscert *tls.Certificate, chainOnly bool) (string, error) {
 	var buf bytes.Buffer
 
-	for _, b := range tlscert.Certificate {
+	certs := tlscert.Certificate
+	if chainOnly && len(certs) > 0 {
+		// Skip the leaf certificate
+		certs = certs[1:]
+	}
+	for _, b := range certs {
 		pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
 		if err := pem.Encode(&buf, pb); err != nil {
 			return "", err
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"time"
 	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
@@ -28,6 +31,11 @@ func acceptTCPMessage(ln *net.TCPListener, message string, c chan bool) {
 	}).Info("Accepted a new TCP connection")
 	defer conn.Close()
 
+	c <- receiveTCPMessage(conn, message)
+}
+
+// receiveTCPMessage tells whether the next line read from conn is message
+func receiveTCPMessage(conn net.Conn, message string) bool {
 	log.WithFields(log.Fields{
 		"localAddress":  conn.LocalAddr(),
 		"remoteAddress": conn.RemoteAddr(),
@@ -38,23 +46,20 @@ func acceptTCPMessage(ln *net.TCPListener, message string, c chan bool) {
 			"localAddress":  conn.LocalAddr(),
 			"remoteAddress": conn.RemoteAddr(),
 		}).Error("Error reading from the TCP connection")
-		c <- false
-		return
+		return false
 	} else if !utf8.Valid(buf) {
 		log.WithFields(log.Fields{
 			"localAddress":  conn.LocalAddr(),
 			"remoteAddress": conn.RemoteAddr(),
 		}).Error("Non-UTF-8 bytes received from the TCP connection")
-		c <- false
-		return
+		return false
 	} else if isPrefix {
 		log.WithFields(log.Fields{
 			"localAddress":  conn.LocalAddr(),
 			"remoteAddress": conn.RemoteAddr(),
 			"message":       string(buf),
 		}).Error("Received message didn't fit in the input buffer")
-		c <- false
-		return
+		return false
 	} else if string(buf) != message {
 		log.WithFields(log.Fields{
 			"localAddress":  conn.LocalAddr(),
@@ -62,19 +67,20 @@ func acceptTCPMessage(ln *net.TCPListener, message string, c chan bool) {
 			"expected":      message,
 			"message":       string(buf),
 		}).Error("Received message did not match the expected message")
-		c <- false
-		return
+		return false
 	}
 
-	c <- true
+	return true
 }
 
-func sendTCPMessage(network, addr, message string) (conn net.Conn, err error) {
+// sendTCPMessage connects to addr, waiting at most timeout (zero for no
+// limit), and writes message as a line
+func sendTCPMessage(network, addr, message string, timeout time.Duration) (conn net.Conn, err error) {
 	log.WithFields(log.Fields{
 		"network": network,
 		"address": addr,
 	}).Info("Trying to connect to a TCP socket")
-	conn, err = net.Dial(network, addr)
+	conn, err = net.DialTimeout(network, addr, timeout)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"network": network,
@@ -131,7 +137,7 @@ func testTCPConnectivity(network, publicAddr, privateAddr string) bool {
 	go acceptTCPMessage(ln, privateAddr, ch)
 
 	success := false
-	conn, err := sendTCPMessage(network, publicAddr, privateAddr)
+	conn, err := sendTCPMessage(network, publicAddr, privateAddr, 0)
 	if conn != nil {
 		defer conn.Close()
 	}
@@ -153,3 +159,43 @@ func testTCPConnectivity(network, publicAddr, privateAddr string) bool {
 
 	return success
 }
+
+// testTCPPort tells whether a TCP connection to addr can be opened within
+// timeout, without sending anything
+func testTCPPort(network, addr string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"network": network,
+			"address": addr,
+			"error":   err.Error(),
+		}).Debug("Error connecting to a TCP socket")
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// testTCPEcho tells whether the service at addr echoes back a random nonce
+// sent as a line, all within timeout
+func testTCPEcho(network, addr string, timeout time.Duration) bool {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Error generating a nonce")
+		return false
+	}
+	nonce := hex.EncodeToString(b)
+
+	deadline := time.Now().Add(timeout)
+	conn, err := sendTCPMessage(network, addr, nonce, timeout)
+	if conn != nil {
+		defer conn.Close()
+	}
+	if err != nil {
+		return false
+	}
+	conn.SetDeadline(deadline)
+	return receiveTCPMessage(conn, nonce)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
@@ -11,8 +13,6 @@ import (
 	"github.com/miekg/dns"
 )
 
-const SOAString string = "@ SOA prisoner.iana.org. hostmaster.root-servers.org. 2002040800 1800 900 0604800 604800"
-
 func isIPv4(addr net.IP) bool {
 	return strings.Contains(addr.String(), ".")
 }
@@ -71,56 +71,239 @@ func getTXTRecords(fqdn string, recordTTL int, values []string) ([]dns.RR, error
 	return records, nil
 }
 
-func processQuery(db Database, msg *dns.Msg, soa dns.RR, ns []dns.RR, config dnsConfig) error {
-	var (
-		answer []dns.RR
-	)
+// hostTable holds the names in the zone whose addresses are served from the
+// configuration rather than the database: the apex, the server itself if it
+// acts as an in-zone nameserver, and names encoding an address in one of the
+// configured networks.
+type hostTable struct {
+	static   map[string][]net.IP
+	zone     string
+	networks []*net.IPNet
+}
 
-	// Multiple questions are never used in practice
-	q := msg.Question[0]
+// getHosts returns the hosts of the zone domain
+func getHosts(domain string, server serverConfig, networks []string) *hostTable {
+	var ipaddrs []net.IP
+	for _, addr := range server.Addresses {
+		if ip := net.ParseIP(addr); ip != nil {
+			ipaddrs = append(ipaddrs, ip)
+		}
+	}
 
-	// Use 1 second timeout for the database queries to avoid stalling
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	hosts := &hostTable{static: make(map[string][]net.IP), zone: getDomain(domain)}
+	for _, cidr := range networks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			hosts.networks = append(hosts.networks, network)
+		}
+	}
+	if len(ipaddrs) == 0 {
+		return hosts
+	}
+	hosts.static[getDomain(domain)] = ipaddrs
+	if dns.IsSubDomain(dns.Fqdn(domain), dns.Fqdn(server.Hostname)) {
+		hosts.static[getDomain(server.Hostname)] = ipaddrs
+	}
+	return hosts
+}
 
-	domain := getDomain(q.Name)
+// getEncodedIP returns the address encoded in label, either an IPv4 address
+// with dashes for dots, e.g. 10-6-3-8, or an IPv6 address as 32 hex digits
+func getEncodedIP(label string) net.IP {
+	if len(label) == 2*net.IPv6len {
+		if b, err := hex.DecodeString(label); err == nil {
+			return net.IP(b)
+		}
+		return nil
+	}
+	if strings.Count(label, "-") != 3 {
+		return nil
+	}
+	ip := net.ParseIP(strings.Replace(label, "-", ".", -1))
+	if ip == nil || ip.To4() == nil {
+		return nil
+	}
+	return ip
+}
+
+// get returns the addresses of domain, if it is a host
+func (h *hostTable) get(domain string) ([]net.IP, bool) {
+	if ipaddrs, ok := h.static[domain]; ok {
+		return ipaddrs, true
+	}
+
+	// Encoded addresses are only taken from names directly below the zone
+	if len(h.networks) == 0 || !strings.HasSuffix(domain, "."+h.zone) {
+		return nil, false
+	}
+	label := strings.TrimSuffix(domain, "."+h.zone)
+	if strings.Contains(label, ".") {
+		return nil, false
+	}
+	ip := getEncodedIP(label)
+	if ip == nil {
+		return nil, false
+	}
+	for _, network := range h.networks {
+		if network.Contains(ip) {
+			return []net.IP{ip}, true
+		}
+	}
+	return nil, false
+}
+
+// getGlueRecords returns the A and AAAA records of the in-zone nameservers
+func getGlueRecords(hosts *hostTable, nameservers []string, recordTTL int) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, ns := range nameservers {
+		ipaddrs, ok := hosts.get(getDomain(ns))
+		if !ok {
+			continue
+		}
+		arecords, err := getARecords(dns.Fqdn(ns), recordTTL, ipaddrs)
+		if err != nil {
+			return nil, err
+		}
+		aaaarecords, err := getAAAARecords(dns.Fqdn(ns), recordTTL, ipaddrs)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, arecords...)
+		records = append(records, aaaarecords...)
+	}
+	return records, nil
+}
+
+// getAnswer returns the records of type qtype at name, and whether name exists
+func getAnswer(ctx context.Context, db Database, name string, qtype uint16, soa dns.RR, ns []dns.RR, hosts *hostTable, signer *zoneSigner, config dnsConfig) ([]dns.RR, bool, error) {
+	var answer []dns.RR
+
+	domain := getDomain(name)
 	domainExists, err := db.DoesDomainExist(ctx, domain)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
+	// The apex always exists, it holds the SOA and NS records
+	isApex := domain == getDomain(config.Domain)
+	hostips, isHost := hosts.get(domain)
+	domainExists = domainExists || isApex || isHost
+
 	recordTTL := config.RecordTTL
 
-	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
 		ipaddrs, err := db.GetIPAddresses(ctx, domain)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
-		if q.Qtype == dns.TypeA {
-			answer, err = getARecords(q.Name, recordTTL, ipaddrs)
+		if isHost {
+			ipaddrs = hostips
+		}
+		if qtype == dns.TypeA {
+			answer, err = getARecords(name, recordTTL, ipaddrs)
 		} else {
-			answer, err = getAAAARecords(q.Name, recordTTL, ipaddrs)
+			answer, err = getAAAARecords(name, recordTTL, ipaddrs)
 		}
 		if err != nil {
-			return err
+			return nil, false, err
 		}
-	} else if q.Qtype == dns.TypeTXT {
+	} else if qtype == dns.TypeTXT {
 		txtvals, err := db.GetTXTValues(ctx, domain)
 		if err != nil {
-			return err
+			return nil, false, err
+		}
+		answer, err = getTXTRecords(name, recordTTL, txtvals)
+		if err != nil {
+			return nil, false, err
+		}
+	} else if isRecordType(qtype) {
+		values, err := db.GetRecords(ctx, domain, qtype)
+		if err != nil {
+			return nil, false, err
 		}
-		answer, err = getTXTRecords(q.Name, recordTTL, txtvals)
+		answer, err = getRecords(name, recordTTL, qtype, values)
+		if err != nil {
+			return nil, false, err
+		}
+	} else if qtype == dns.TypeSOA && isApex {
+		answer = []dns.RR{soa}
+	} else if qtype == dns.TypeNS && isApex {
+		answer = ns
+	} else if qtype == dns.TypeDNSKEY && isApex && signer != nil {
+		answer = []dns.RR{signer.dnskey}
+	} else if qtype == dns.TypeANY && domainExists {
+		// Minimal response to ANY queries, see RFC 8482
+		answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(recordTTL)},
+			Cpu: "RFC8482",
+		}}
+	}
+	return answer, domainExists, nil
+}
+
+// getCNAME returns the CNAME record of name to follow for qtype, if any
+func getCNAME(ctx context.Context, db Database, name string, qtype uint16, config dnsConfig) (*dns.CNAME, error) {
+	domain := getDomain(name)
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY || domain == getDomain(config.Domain) {
+		return nil, nil
+	}
+	values, err := db.GetRecords(ctx, domain, dns.TypeCNAME)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	records, err := getRecords(name, config.RecordTTL, dns.TypeCNAME, values[:1])
+	if err != nil {
+		return nil, err
+	}
+	return records[0].(*dns.CNAME), nil
+}
+
+func processQuery(db Database, msg *dns.Msg, soa dns.RR, ns []dns.RR, hosts *hostTable, signer *zoneSigner, config dnsConfig) error {
+	var (
+		answer       []dns.RR
+		chain        []dns.RR
+		domainExists bool
+		leftZone     bool // the last CNAME points outside the zone, or loops
+	)
+
+	// Multiple questions are never used in practice
+	q := msg.Question[0]
+
+	// Use 1 second timeout for the database queries to avoid stalling
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Follow CNAMEs within the zone, the resolver follows the others
+	name := q.Name
+	seen := make(map[string]bool)
+	for {
+		cname, err := getCNAME(ctx, db, name, q.Qtype, config)
 		if err != nil {
 			return err
 		}
+		if cname == nil {
+			answer, domainExists, err = getAnswer(ctx, db, name, q.Qtype, soa, ns, hosts, signer, config)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		chain = append(chain, cname)
+		seen[getDomain(name)] = true
+		name = cname.Target
+		if !dns.IsSubDomain(dns.Fqdn(config.Domain), name) || seen[getDomain(name)] || len(chain) >= maxCNAMEChain {
+			leftZone = true
+			break
+		}
 	}
 
-	if len(answer) == 0 {
+	if len(answer) == 0 && !leftZone {
 		// Default response is authoritative with SOA
 		msg.Authoritative = true
+		msg.Answer = chain
 		msg.Ns = []dns.RR{soa}
 		if !domainExists {
-			// No records for the whole domain
+			// No records for the whole domain nor any name below it,
+			// otherwise the answer is NODATA
 			msg.Rcode = dns.RcodeNameError
 		}
 		return nil
@@ -128,12 +311,49 @@ func processQuery(db Database, msg *dns.Msg, soa dns.RR, ns []dns.RR, config dns
 
 	// Send a successful response with an answer
 	msg.Authoritative = true
-	msg.Ns = ns
-	msg.Answer = answer
+	if q.Qtype != dns.TypeNS {
+		msg.Ns = ns
+	}
+	msg.Answer = append(chain, answer...)
+	if q.Qtype == dns.TypeNS {
+		// Save the resolver a lookup of the in-zone nameservers
+		var err error
+		msg.Extra, err = getGlueRecords(hosts, config.NameServers, config.RecordTTL)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func getHandler(db Database, domain string, nameservers []string, config dnsConfig) func(dns.ResponseWriter, *dns.Msg) {
+// getMailbox converts an email address into the domain name form used in the
+// SOA record, e.g. "john.doe@example.org" into "john\.doe.example.org."
+// Names already in that form are returned as FQDNs.
+func getMailbox(nsadmin string) string {
+	at := strings.LastIndex(nsadmin, "@")
+	if at < 0 {
+		return dns.Fqdn(strings.ToLower(nsadmin))
+	}
+	local := strings.Replace(nsadmin[:at], ".", "\\.", -1)
+	return dns.Fqdn(strings.ToLower(local + "." + nsadmin[at+1:]))
+}
+
+func getSOARecord(domain string, serial uint32, config dnsConfig) *dns.SOA {
+	// The TTL of the SOA record also caps how long negative answers are
+	// cached (RFC 2308), so it is the same as the minimum
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(config.Minimum)},
+		Ns:      dns.Fqdn(strings.ToLower(config.NameServers[0])),
+		Mbox:    getMailbox(config.NsAdmin),
+		Serial:  serial,
+		Refresh: uint32(config.Refresh),
+		Retry:   uint32(config.Retry),
+		Expire:  uint32(config.Expire),
+		Minttl:  uint32(config.Minimum),
+	}
+}
+
+func getHandler(db Database, journal *zoneJournal, domain string, nameservers []string, hosts *hostTable, signer *zoneSigner, views []clientView, resolvers []*net.IPNet, health *healthChecker, limiter *rateLimiter, config dnsConfig) func(dns.ResponseWriter, *dns.Msg) {
 	nshdr := dns.RR_Header{Name: domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}
 
 	var nsrr []dns.RR
@@ -144,29 +364,209 @@ func getHandler(db Database, domain string, nameservers []string, config dnsConf
 		nsrr = append(nsrr, rr)
 	}
 
-	SOAFormat := fmt.Sprintf("%s SOA %s %s %%s 28800 7200 604800 86400", strings.ToLower(domain), strings.ToLower(nameservers[0]), "admin.domain.foo")
+	secret, err := newCookieSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Stale answers are kept per view, as the addresses differ
+	caches := map[string]*staleCache{"": {}}
+	for _, view := range views {
+		caches[view.name] = &staleCache{}
+	}
 
 	return func(w dns.ResponseWriter, req *dns.Msg) {
-		serial := time.Now().Format("2006010215")
-		SOAString := fmt.Sprintf(SOAFormat, serial)
-		SOA, err := dns.NewRR(SOAString)
-		if err != nil {
-			// FIXME: Handle error, should not happen
-		}
-
 		msg := new(dns.Msg)
 		msg.SetReply(req)
 
-		if req.Opcode == dns.OpcodeQuery {
-			if err := processQuery(db, msg, SOA, nsrr, config); err != nil {
-				// FIXME: Handle ServFail
+		remoteIP := getRemoteIP(w.RemoteAddr())
+		opt, rcode, validCookie := getEdns0(req, remoteIP, secret)
+
+		// Pick the view by the address of the client, as told by its
+		// resolver if trusted to. The option of others is ignored.
+		clientIP := remoteIP
+		var subnet *dns.EDNS0_SUBNET
+		if isTrustedResolver(remoteIP, resolvers) {
+			subnet = getClientSubnet(req)
+		}
+		if subnet != nil {
+			clientIP = nil
+			if subnet.SourceNetmask > 0 {
+				clientIP = subnet.Address
+			}
+		}
+		view := getView(views, clientIP)
+		viewdb, cache := db, caches[view]
+		if view != "" {
+			viewdb = &viewDatabase{Database: db, view: view}
+		}
+		if health != nil {
+			viewdb = &healthDatabase{Database: viewdb, health: health}
+		}
+		if rcode == dns.RcodeSuccess && req.Opcode != dns.OpcodeUpdate {
+			rcode = checkQuery(req, domain)
+		}
+		if rcode == dns.RcodeSuccess && req.Opcode == dns.OpcodeQuery && isTransfer(req) {
+			SOA, err := getCurrentSOA(db, domain, config)
+			if err == nil {
+				err = transferZone(w, req, db, journal, SOA, nsrr, hosts, config)
+			}
+			if err != nil {
+				fmt.Printf("Zone transfer to %s failed with error: %v\n", w.RemoteAddr(), err)
+			}
+			return
+		}
+		if rcode != dns.RcodeSuccess {
+			msg.Rcode = rcode
+		} else if req.Opcode == dns.OpcodeUpdate {
+			var err error
+			msg.Rcode, err = updateZone(req, w.TsigStatus(), remoteIP, db, domain, nsrr, hosts, config)
+			if err != nil {
+				fmt.Printf("SERVFAIL for update of %s from %s: %v\n", domain, w.RemoteAddr(), err)
+			}
+		} else if err := answerQuery(viewdb, msg, domain, nsrr, hosts, signer, config); err != nil {
+			if stale, ok := cache.get(req); ok {
+				fmt.Printf("Serving stale answer for %s %s from %s: %v\n", req.Question[0].Name,
+					dns.TypeToString[req.Question[0].Qtype], w.RemoteAddr(), err)
+				msg = stale
+			} else {
+				fmt.Printf("SERVFAIL for %s %s from %s: %v\n", req.Question[0].Name,
+					dns.TypeToString[req.Question[0].Qtype], w.RemoteAddr(), err)
+				msg = new(dns.Msg)
+				msg.SetRcode(req, dns.RcodeServerFailure)
+			}
+		} else {
+			cache.put(msg)
+		}
+		if rcode == dns.RcodeSuccess && req.Opcode == dns.OpcodeQuery && msg.Rcode != dns.RcodeServerFailure &&
+			signer != nil && opt != nil && opt.Do() {
+			if err := signer.signResponse(viewdb, msg, hosts, config); err != nil {
+				fmt.Printf("SERVFAIL for %s %s from %s: %v\n", req.Question[0].Name,
+					dns.TypeToString[req.Question[0].Qtype], w.RemoteAddr(), err)
+				msg = new(dns.Msg)
+				msg.SetRcode(req, dns.RcodeServerFailure)
+			}
+		}
+		if opt != nil {
+			if subnet != nil {
+				opt.Option = append(opt.Option, getSubnetReply(subnet, views))
+			}
+			msg.Extra = append(msg.Extra, opt)
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			// Set the TC bit if the response does not fit, so that
+			// the client retries over TCP
+			msg.Truncate(udpSize(req))
+
+			// Requests signed with a known key or with a valid server
+			// cookie come from their source address, and are never limited
+			isSigned := req.IsTsig() != nil && w.TsigStatus() == nil
+			if limiter != nil && !isSigned && !validCookie {
+				switch limiter.check(remoteIP, msg, domain) {
+				case rrlDrop:
+					return
+				case rrlSlip:
+					msg = new(dns.Msg)
+					msg.SetReply(req)
+					if hasCookie(opt) {
+						// Clients supporting cookies retry with the fresh
+						// server cookie, rather than over TCP (RFC 7873)
+						msg.Rcode = dns.RcodeBadCookie
+						msg.Extra = []dns.RR{opt}
+					} else {
+						msg.Truncated = true
+					}
+				}
 			}
 		}
+		if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+			msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		}
 		w.WriteMsg(msg)
 	}
 }
 
-func startDNS(db Database, config dnsConfig) {
+// checkQuery returns the rcode for requests which cannot be answered:
+// opcodes other than QUERY, malformed questions and questions outside the zone
+func checkQuery(req *dns.Msg, domain string) int {
+	if req.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented
+	}
+	if len(req.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	q := req.Question[0]
+	switch q.Qtype {
+	case dns.TypeMAILA, dns.TypeMAILB:
+		return dns.RcodeNotImplemented
+	}
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		return dns.RcodeRefused
+	}
+	if !dns.IsSubDomain(domain, q.Name) {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+// acceptMsg also accepts dynamic updates, which the default rejects because
+// their sections may hold any number of records
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && !isResponse {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func isTransfer(req *dns.Msg) bool {
+	qtype := req.Question[0].Qtype
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// getCurrentSOA returns the SOA record with the current serial number
+func getCurrentSOA(db Database, domain string, config dnsConfig) (*dns.SOA, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	serial, err := db.GetSerial(ctx, getDomain(domain))
+	if err != nil {
+		return nil, err
+	}
+	return getSOARecord(strings.ToLower(domain), serial, config), nil
+}
+
+// answerQuery answers a query checked by checkQuery
+func answerQuery(db Database, msg *dns.Msg, domain string, nsrr []dns.RR, hosts *hostTable, signer *zoneSigner, config dnsConfig) error {
+	SOA, err := getCurrentSOA(db, domain, config)
+	if err != nil {
+		return err
+	}
+	return processQuery(db, msg, SOA, nsrr, hosts, signer, config)
+}
+
+// refuseQuery answers queries for names outside the zone
+func refuseQuery(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(msg)
+}
+
+// udpSize returns the maximum size of a UDP response, the payload size
+// advertised by the client but no more than we are willing to send
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
+
+// serveZone registers the handler of zone, and adds its TSIG keys for zone
+// transfers and dynamic updates to tsigSecret
+func serveZone(zone dnsZone, server serverConfig, views []clientView, health *healthChecker, limiter *rateLimiter, tsigSecret map[string]string) {
+	db, journal, config := zone.db, zone.journal, zone.config
 	domain := dns.Fqdn(config.Domain)
 
 	var nsfqdns []string
@@ -174,9 +574,65 @@ func startDNS(db Database, config dnsConfig) {
 		nsfqdns = append(nsfqdns, dns.Fqdn(nsstr))
 	}
 
-	dns.HandleFunc(domain, getHandler(db, domain, nsfqdns, config))
-	server := &dns.Server{Addr: ":53", Net: "udp"}
+	hosts := getHosts(domain, server, config.SynthesizeNetworks)
+
+	var signer *zoneSigner
+	if config.DNSSEC {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var err error
+		signer, err = getZoneSigner(ctx, db, domain, config.RecordTTL)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if signer != nil && len(config.Secondaries) > 0 {
+		fmt.Printf("Warning: secondaries can't serve the zone %s signed with online DNSSEC\n", config.Domain)
+	}
+
+	dns.HandleFunc(domain, getHandler(db, journal, domain, nsfqdns, hosts, signer, views, getNetworks(server.TrustedResolvers), health,
+		limiter, config))
+
+	if config.TSIGName != "" {
+		tsigSecret[dns.Fqdn(config.TSIGName)] = config.TSIGSecret
+	}
+	for _, key := range config.UpdateKeys {
+		tsigSecret[dns.Fqdn(key.Name)] = key.Secret
+	}
 
-	fmt.Printf("Starting DNS server at localhost:53\n")
-	log.Fatal(server.ListenAndServe())
+	if len(config.Secondaries) > 0 {
+		go sendNotify(journal, func() (*dns.SOA, error) {
+			return getCurrentSOA(db, domain, config)
+		}, config)
+	}
+}
+
+// startDNS serves the zones on the sockets of ls, over TLS too if tlsConfig
+// is set
+func startDNS(zones []dnsZone, server serverConfig, views []clientView, health *healthChecker, limiter *rateLimiter, ls *listeners, tlsConfig *tls.Config) {
+	tsigSecret := make(map[string]string)
+	for _, zone := range zones {
+		serveZone(zone, server, views, health, limiter, tsigSecret)
+	}
+	dns.HandleFunc(".", refuseQuery)
+
+	serve := func(srv *dns.Server, addr net.Addr) {
+		fmt.Printf("Starting DNS server at %s/%s\n", addr, srv.Net)
+		log.Fatal(srv.ActivateAndServe())
+	}
+	for _, pc := range ls.dnsUDP {
+		srv := &dns.Server{PacketConn: pc, Net: "udp", TsigSecret: tsigSecret, MsgAcceptFunc: acceptMsg}
+		go serve(srv, pc.LocalAddr())
+	}
+	for _, ln := range ls.dnsTCP {
+		srv := &dns.Server{Listener: ln, Net: "tcp", TsigSecret: tsigSecret, MsgAcceptFunc: acceptMsg}
+		go serve(srv, ln.Addr())
+	}
+	if tlsConfig != nil {
+		for _, ln := range ls.dot {
+			srv := &dns.Server{Listener: tls.NewListener(ln, tlsConfig), Net: "tcp-tls", TsigSecret: tsigSecret, MsgAcceptFunc: acceptMsg}
+			go serve(srv, ln.Addr())
+		}
+	}
 }
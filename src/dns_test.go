@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	testUDPClient = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	testTCPClient = &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	testServer    = &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}
+)
+
+// testWriter is a dns.ResponseWriter keeping the messages written
+type testWriter struct {
+	remote net.Addr
+	// Result of verifying the TSIG of the request, as the server would
+	tsigStatus error
+	msgs       []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr  { return testServer }
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) Close() error         { return nil }
+func (w *testWriter) TsigStatus() error    { return w.tsigStatus }
+func (w *testWriter) TsigTimersOnly(bool)  {}
+func (w *testWriter) Hijack()              {}
+
+func (w *testWriter) WriteMsg(msg *dns.Msg) error {
+	w.msgs = append(w.msgs, msg)
+	return nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msgs = append(w.msgs, msg)
+	return len(b), nil
+}
+
+// testZone is a zone served from memory
+type testZone struct {
+	config    dnsConfig
+	db        Database
+	journal   *zoneJournal
+	signer    *zoneSigner
+	hosts     *hostTable
+	views     []clientView
+	resolvers []*net.IPNet
+	health    *healthChecker
+	limiter   *rateLimiter
+	handler   func(dns.ResponseWriter, *dns.Msg)
+}
+
+// newTestZone serves the zone of config from an empty MemoryDatabase, the
+// way serveZone does
+func newTestZone(t *testing.T, config dnsConfig) *testZone {
+	if len(config.NameServers) == 0 {
+		config.NameServers = []string{"ns1.example.net"}
+	}
+	if config.RecordTTL == 0 {
+		config.RecordTTL = 300
+	}
+	if config.Minimum == 0 {
+		config.Minimum = config.RecordTTL
+	}
+	domain := dns.Fqdn(config.Domain)
+	journal := newZoneJournal()
+	z := &testZone{
+		config:  config,
+		db:      &serialDatabase{Database: &MemoryDatabase{}, zone: getDomain(domain), journal: journal},
+		journal: journal,
+		hosts:   getHosts(domain, serverConfig{}, config.SynthesizeNetworks),
+	}
+	if config.DNSSEC {
+		var err error
+		if z.signer, err = getZoneSigner(context.Background(), z.db, domain, config.RecordTTL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	z.serve()
+	return z
+}
+
+// serve makes the handler serve the zone as configured in z
+func (z *testZone) serve() {
+	var nameservers []string
+	for _, ns := range z.config.NameServers {
+		nameservers = append(nameservers, dns.Fqdn(ns))
+	}
+	z.handler = getHandler(z.db, z.journal, dns.Fqdn(z.config.Domain), nameservers, z.hosts, z.signer, z.views,
+		z.resolvers, z.health, z.limiter, z.config)
+}
+
+// exchange passes req to the handler as if it came from remote, and returns
+// the response, or nil if there was none
+func (z *testZone) exchange(req *dns.Msg, remote net.Addr) *dns.Msg {
+	w := &testWriter{remote: remote}
+	z.handler(w, req)
+	if len(w.msgs) == 0 {
+		return nil
+	}
+	return w.msgs[len(w.msgs)-1]
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// getRecordStrings returns the records as "<type> <rdata>"
+func getRecordStrings(records []dns.RR) []string {
+	var strs []string
+	for _, rr := range records {
+		strs = append(strs, dns.TypeToString[rr.Header().Rrtype]+" "+rr.String()[len(rr.Header().String()):])
+	}
+	return strs
+}
+
+func TestCheckQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode int
+		qname  string
+		qtype  uint16
+		qclass uint16
+		rcode  int
+	}{
+		{"query", dns.OpcodeQuery, "a.example.org.", dns.TypeA, dns.ClassINET, dns.RcodeSuccess},
+		{"class ANY", dns.OpcodeQuery, "a.example.org.", dns.TypeA, dns.ClassANY, dns.RcodeSuccess},
+		{"status", dns.OpcodeStatus, "a.example.org.", dns.TypeA, dns.ClassINET, dns.RcodeNotImplemented},
+		{"MAILB", dns.OpcodeQuery, "a.example.org.", dns.TypeMAILB, dns.ClassINET, dns.RcodeNotImplemented},
+		{"class CHAOS", dns.OpcodeQuery, "a.example.org.", dns.TypeTXT, dns.ClassCHAOS, dns.RcodeRefused},
+		{"other zone", dns.OpcodeQuery, "a.example.com.", dns.TypeA, dns.ClassINET, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		req.Opcode = tt.opcode
+		req.Question[0].Qclass = tt.qclass
+		if rcode := checkQuery(req, "example.org."); rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s; want %s", tt.name, dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestNameErrors(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutIPAddresses(ctx, "b.c.example.org", []net.IP{net.ParseIP("192.0.2.2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"answer", "a.example.org.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"no data", "a.example.org.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{"no data at the apex", "example.org.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{"empty non-terminal", "c.example.org.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"nonexistent name", "x.example.org.", dns.TypeA, dns.RcodeNameError, 0},
+		{"below a name", "x.a.example.org.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		msg := z.exchange(req, testTCPClient)
+		if msg.Rcode != tt.rcode || len(msg.Answer) != tt.answers {
+			t.Errorf("%s: rcode = %s with %d answers; want %s with %d", tt.name, dns.RcodeToString[msg.Rcode],
+				len(msg.Answer), dns.RcodeToString[tt.rcode], tt.answers)
+		}
+		if !msg.Authoritative {
+			t.Errorf("%s: answer not authoritative", tt.name)
+		}
+		// Negative answers carry the SOA record, for their TTL
+		if tt.answers == 0 && (len(msg.Ns) != 1 || msg.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Errorf("%s: authority = %v; want the SOA record", tt.name, msg.Ns)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	ctx := context.Background()
+	// About 16 bytes per address in the response
+	for _, n := range []int{40, 100} {
+		var ipaddrs []net.IP
+		for i := 0; i < n; i++ {
+			ipaddrs = append(ipaddrs, net.IPv4(192, 0, 2, byte(i)))
+		}
+		if err := z.db.PutIPAddresses(ctx, fmt.Sprintf("a%d.example.org", n), ipaddrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		remote net.Addr
+		// UDP payload size advertised with EDNS0, none if zero
+		bufsize   uint16
+		truncated bool
+	}{
+		{"small", "a40.example.org.", testUDPClient, 0, true},
+		{"small over TCP", "a40.example.org.", testTCPClient, 0, false},
+		{"large buffer", "a40.example.org.", testUDPClient, 1232, false},
+		{"buffer below the minimum", "a40.example.org.", testUDPClient, 256, true},
+		{"too large", "a100.example.org.", testUDPClient, 1232, true},
+		{"larger buffer than ours", "a100.example.org.", testUDPClient, 4096, true},
+		{"too large over TCP", "a100.example.org.", testTCPClient, 4096, false},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		size := dns.MinMsgSize
+		if tt.bufsize > 0 {
+			req.SetEdns0(tt.bufsize, false)
+			if int(tt.bufsize) > size {
+				size = int(tt.bufsize)
+			}
+		}
+		msg := z.exchange(req, tt.remote)
+		if msg.Truncated != tt.truncated {
+			t.Errorf("%s: truncated = %v; want %v", tt.name, msg.Truncated, tt.truncated)
+		}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, isUDP := tt.remote.(*net.UDPAddr); isUDP && len(b) > size {
+			t.Errorf("%s: %d byte response over UDP; want at most %d", tt.name, len(b), size)
+		}
+		if !tt.truncated && len(msg.Answer) == 0 {
+			t.Errorf("%s: no answer", tt.name)
+		}
+	}
+}
+
+func TestServerHosts(t *testing.T) {
+	server := serverConfig{Hostname: "ns1.example.org", Addresses: []string{"192.0.2.53", "2001:db8::53"}}
+	z := newTestZone(t, dnsConfig{Domain: "example.org", NameServers: []string{"ns1.example.org", "ns2.example.net"}})
+	z.hosts = getHosts("example.org.", server, nil)
+	z.serve()
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		answer []string
+		extra  []string
+	}{
+		{"apex", "example.org.", dns.TypeA, []string{"A 192.0.2.53"}, nil},
+		{"apex IPv6", "example.org.", dns.TypeAAAA, []string{"AAAA 2001:db8::53"}, nil},
+		{"nameserver", "ns1.example.org.", dns.TypeA, []string{"A 192.0.2.53"}, nil},
+		{"nameserver IPv6", "ns1.example.org.", dns.TypeAAAA, []string{"AAAA 2001:db8::53"}, nil},
+		{"nameservers", "example.org.", dns.TypeNS, []string{"NS ns1.example.org.", "NS ns2.example.net."},
+			[]string{"A 192.0.2.53", "AAAA 2001:db8::53"}},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		msg := z.exchange(req, testTCPClient)
+		if answer := getRecordStrings(msg.Answer); fmt.Sprint(answer) != fmt.Sprint(tt.answer) {
+			t.Errorf("%s: answer = %v; want %v", tt.name, answer, tt.answer)
+		}
+		if extra := getRecordStrings(msg.Extra); fmt.Sprint(extra) != fmt.Sprint(tt.extra) {
+			t.Errorf("%s: additional = %v; want %v", tt.name, extra, tt.extra)
+		}
+	}
+
+	// A server outside the zone only answers for the apex
+	hosts := getHosts("example.org.", serverConfig{Hostname: "dns.example.net", Addresses: server.Addresses}, nil)
+	if _, ok := hosts.get("dns.example.net"); ok || len(hosts.static) != 1 {
+		t.Errorf("hosts of a server outside the zone = %v; want the apex only", hosts.static)
+	}
+	// Without addresses there are no hosts
+	hosts = getHosts("example.org.", serverConfig{Hostname: "ns1.example.org"}, nil)
+	if len(hosts.static) != 0 {
+		t.Errorf("hosts of a server without addresses = %v; want none", hosts.static)
+	}
+}
+
+func TestGetEncodedIP(t *testing.T) {
+	tests := []struct {
+		label string
+		ip    string // "" for none
+	}{
+		{"10-6-3-8", "10.6.3.8"},
+		{"0-0-0-0", "0.0.0.0"},
+		{"10-6-3", ""},
+		{"10-6-3-8-1", ""},
+		{"10-6-3-256", ""},
+		{"10-6-3-x", ""},
+		{"10--3-8", ""},
+		{"10.6.3.8", ""},
+		{"fd000000000000000000000000000001", "fd00::1"},
+		{"FD000000000000000000000000000001", "fd00::1"},
+		{"fd00000000000000000000000000001", ""},
+		{"fd0000000000000000000000000000001", ""},
+		{"fd00000000000000000000000000000g", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		var ip string
+		if encoded := getEncodedIP(tt.label); encoded != nil {
+			ip = encoded.String()
+		}
+		if ip != tt.ip {
+			t.Errorf("getEncodedIP(%q) = %q; want %q", tt.label, ip, tt.ip)
+		}
+	}
+}
+
+func TestEncodedNames(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org", SynthesizeNetworks: []string{"10.0.0.0/8", "fd00::/8"}})
+	if err := z.db.PutIPAddresses(context.Background(), "10-0-0-2.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{"10-6-3-8.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.6.3.8"}},
+		{"10-6-3-8.example.org.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"fd000000000000000000000000000001.example.org.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA fd00::1"}},
+		// Encoded names are answered whatever is stored
+		{"10-0-0-2.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"192-0-2-1.example.org.", dns.TypeA, dns.RcodeNameError, nil},
+		{"20010db8000000000000000000000001.example.org.", dns.TypeAAAA, dns.RcodeNameError, nil},
+		{"a.10-6-3-8.example.org.", dns.TypeA, dns.RcodeNameError, nil},
+		{"10-6-3.example.org.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		msg := z.exchange(req, testTCPClient)
+		answer := getRecordStrings(msg.Answer)
+		if msg.Rcode != tt.rcode || fmt.Sprint(answer) != fmt.Sprint(tt.answer) {
+			t.Errorf("%s %s: rcode = %s, answer = %v; want %s, %v", tt.qname, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[msg.Rcode], answer, dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	cnames := map[string]string{
+		"c1.example.org":    "c2.example.org.",
+		"c2.example.org":    "a.example.org.",
+		"loop1.example.org": "loop2.example.org.",
+		"loop2.example.org": "loop1.example.org.",
+		"out.example.org":   "www.example.com.",
+		"none.example.org":  "x.example.org.",
+	}
+	// A chain longer than followed
+	for i := 0; i < maxCNAMEChain+1; i++ {
+		cnames[fmt.Sprintf("d%d.example.org", i)] = fmt.Sprintf("d%d.example.org.", i+1)
+	}
+	cnames[fmt.Sprintf("d%d.example.org", maxCNAMEChain+1)] = "a.example.org."
+	for domain, target := range cnames {
+		if err := z.db.PutRecords(ctx, domain, dns.TypeCNAME, []string{target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only maxCNAMEChain records of it are answered
+	var long []string
+	for i := 0; i < maxCNAMEChain; i++ {
+		long = append(long, fmt.Sprintf("d%d.example.org. CNAME", i))
+	}
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode int
+		// Owner names and types of the answer
+		answer []string
+	}{
+		{"chain", "c1.example.org.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"c1.example.org. CNAME", "c2.example.org. CNAME", "a.example.org. A"}},
+		{"chain without data", "c1.example.org.", dns.TypeTXT, dns.RcodeSuccess,
+			[]string{"c1.example.org. CNAME", "c2.example.org. CNAME"}},
+		{"CNAME query", "c1.example.org.", dns.TypeCNAME, dns.RcodeSuccess, []string{"c1.example.org. CNAME"}},
+		{"target missing", "none.example.org.", dns.TypeA, dns.RcodeNameError, []string{"none.example.org. CNAME"}},
+		{"out of zone", "out.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"out.example.org. CNAME"}},
+		{"loop", "loop1.example.org.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"loop1.example.org. CNAME", "loop2.example.org. CNAME"}},
+		{"too long", "d0.example.org.", dns.TypeA, dns.RcodeSuccess, long},
+	}
+
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		msg := z.exchange(req, testTCPClient)
+		var answer []string
+		for _, rr := range msg.Answer {
+			answer = append(answer, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+		if msg.Rcode != tt.rcode || fmt.Sprint(answer) != fmt.Sprint(tt.answer) {
+			t.Errorf("%s: rcode = %s, answer = %v; want %s, %v", tt.name, dns.RcodeToString[msg.Rcode], answer,
+				dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Signatures are valid from a bit in the past, to allow for clock skew,
+	// until well beyond the TTL of any record
+	signInception  = time.Hour
+	signExpiration = 7 * 24 * time.Hour
+)
+
+// zoneSigner signs the answers of a zone online with a single ECDSA P-256
+// key, acting both as key and zone signing key
+type zoneSigner struct {
+	zone   string // FQDN
+	key    *ecdsa.PrivateKey
+	dnskey *dns.DNSKEY
+}
+
+func getKeyName(zone string) string {
+	return "dnssec_" + getDomain(zone) + "+key"
+}
+
+// getZoneSigner loads the signing key of zone from the database, generating
+// and storing a new one if there is none yet
+func getZoneSigner(ctx context.Context, db Database, zone string, ttl int) (*zoneSigner, error) {
+	name := getKeyName(zone)
+	data, err := db.GetCertificate(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *ecdsa.PrivateKey
+	if data == nil {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := encodeECDSAKey(&buf, key); err != nil {
+			return nil, err
+		}
+		if err := db.PutCertificate(ctx, name, buf.Bytes()); err != nil {
+			return nil, err
+		}
+	} else {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("Invalid DNSSEC key")
+		}
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The public key is the concatenation of X and Y, see RFC 6605
+	pub := make([]byte, 64)
+	x, y := key.PublicKey.X.Bytes(), key.PublicKey.Y.Bytes()
+	copy(pub[32-len(x):32], x)
+	copy(pub[64-len(y):], y)
+
+	zone = dns.Fqdn(strings.ToLower(zone))
+	return &zoneSigner{
+		zone: zone,
+		key:  key,
+		dnskey: &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+			PublicKey: base64.StdEncoding.EncodeToString(pub),
+		},
+	}, nil
+}
+
+// ds returns the DS record to publish in the parent zone
+func (s *zoneSigner) ds() *dns.DS {
+	return s.dnskey.ToDS(dns.SHA256)
+}
+
+// signRecords returns records followed by a signature for each RRset in them.
+// OPT records are passed through unsigned.
+func (s *zoneSigner) signRecords(records []dns.RR) ([]dns.RR, error) {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var (
+		keys   []rrsetKey
+		rrsets = make(map[rrsetKey][]dns.RR)
+	)
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	// Always allocate, records may be shared with other responses
+	signed := make([]dns.RR, 0, len(records)+len(keys))
+	signed = append(signed, records...)
+	now := time.Now()
+	for _, key := range keys {
+		rrset := rrsets[key]
+		rrsig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  s.dnskey.Algorithm,
+			SignerName: s.zone,
+			KeyTag:     s.dnskey.KeyTag(),
+			Inception:  uint32(now.Add(-signInception).Unix()),
+			Expiration: uint32(now.Add(signExpiration).Unix()),
+		}
+		if err := rrsig.Sign(s.key, rrset); err != nil {
+			return nil, err
+		}
+		signed = append(signed, rrsig)
+	}
+	return signed, nil
+}
+
+// getTypes returns the record types which exist at domain
+func getTypes(ctx context.Context, db Database, domain string, hosts *hostTable, isApex bool) ([]uint16, error) {
+	var types []uint16
+	if isApex {
+		types = append(types, dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY)
+	}
+
+	ipaddrs, err := db.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if hostips, ok := hosts.get(domain); ok {
+		ipaddrs = hostips
+	}
+	var hasA, hasAAAA bool
+	for _, ip := range ipaddrs {
+		if isIPv4(ip) {
+			hasA = true
+		} else {
+			hasAAAA = true
+		}
+	}
+	if hasA {
+		types = append(types, dns.TypeA)
+	}
+	if hasAAAA {
+		types = append(types, dns.TypeAAAA)
+	}
+
+	txtvals, err := db.GetTXTValues(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(txtvals) > 0 {
+		types = append(types, dns.TypeTXT)
+	}
+
+	for _, rrtype := range recordTypes {
+		values, err := db.GetRecords(ctx, domain, rrtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			types = append(types, rrtype)
+		}
+	}
+	return types, nil
+}
+
+// signResponse signs the records in msg. Negative answers are proven with
+// minimal NSEC records ("black lies"): the NSEC covers only the query name,
+// which is claimed to exist, so that nonexistent names can't be enumerated.
+func (s *zoneSigner) signResponse(db Database, msg *dns.Msg, hosts *hostTable, config dnsConfig) error {
+	q := msg.Question[0]
+
+	// After following CNAMEs, the answer is about the last name
+	name := q.Name
+	hasAnswer := false
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+			name = cname.Target
+		} else {
+			hasAnswer = true
+		}
+	}
+
+	if dns.IsSubDomain(s.zone, name) &&
+		(msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && !hasAnswer)) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var types []uint16
+		if msg.Rcode == dns.RcodeSuccess {
+			domain := getDomain(name)
+			var err error
+			types, err = getTypes(ctx, db, domain, hosts, domain == getDomain(s.zone))
+			if err != nil {
+				return err
+			}
+		}
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+		msg.Rcode = dns.RcodeSuccess
+		msg.Ns = append(msg.Ns, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: uint32(config.Minimum)},
+			NextDomain: "\\000." + name,
+			TypeBitMap: types,
+		})
+	}
+
+	var err error
+	if msg.Answer, err = s.signRecords(msg.Answer); err != nil {
+		return err
+	}
+	if msg.Ns, err = s.signRecords(msg.Ns); err != nil {
+		return err
+	}
+	if msg.Extra, err = s.signRecords(msg.Extra); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSignResponseNSEC(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org", DNSSEC: true})
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutTXTValues(ctx, "a.example.org", []string{`"v"`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutRecords(ctx, "a.example.org", dns.TypeCAA, []string{`0 issue "letsencrypt.org"`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutIPAddresses(ctx, "b.c.example.org", []net.IP{net.ParseIP("2001:db8::1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		// Types in the NSEC record proving the negative answer, none if
+		// the answer is positive
+		types []uint16
+	}{
+		{"positive", "a.example.org.", dns.TypeA, nil},
+		{"no data", "a.example.org.", dns.TypeMX,
+			[]uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeCAA}},
+		{"no data at the apex", "example.org.", dns.TypeMX,
+			[]uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{"IPv6 only", "b.c.example.org.", dns.TypeA,
+			[]uint16{dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"empty non-terminal", "c.example.org.", dns.TypeA,
+			[]uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+		{"nonexistent name", "x.example.org.", dns.TypeA,
+			[]uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		req.SetEdns0(4096, true)
+		msg := z.exchange(req, testTCPClient)
+
+		// Black lies: nonexistent names are claimed to exist, too
+		if msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: rcode = %s; want NOERROR", tt.name, dns.RcodeToString[msg.Rcode])
+		}
+
+		var (
+			nsec   *dns.NSEC
+			rrsigs = make(map[uint16]*dns.RRSIG)
+		)
+		for _, rr := range append(msg.Answer, msg.Ns...) {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = rr
+			case *dns.RRSIG:
+				rrsigs[rr.TypeCovered] = rr
+			}
+		}
+		if tt.types == nil {
+			if nsec != nil || len(msg.Answer) == 0 || rrsigs[tt.qtype] == nil {
+				t.Errorf("%s: got %v; want a signed answer", tt.name, msg)
+			}
+			continue
+		}
+		if nsec == nil {
+			t.Errorf("%s: no NSEC record in %v", tt.name, msg)
+			continue
+		}
+		if nsec.Hdr.Name != tt.qname || nsec.NextDomain != "\\000."+tt.qname {
+			t.Errorf("%s: NSEC covers %s to %s; want only %s", tt.name, nsec.Hdr.Name, nsec.NextDomain, tt.qname)
+		}
+		if !reflect.DeepEqual(nsec.TypeBitMap, tt.types) {
+			t.Errorf("%s: NSEC types = %v; want %v", tt.name, nsec.TypeBitMap, tt.types)
+		}
+		rrsig := rrsigs[dns.TypeNSEC]
+		if rrsig == nil {
+			t.Errorf("%s: NSEC record not signed", tt.name)
+		} else if err := rrsig.Verify(z.signer.dnskey, []dns.RR{nsec}); err != nil {
+			t.Errorf("%s: NSEC signature: %v", tt.name, err)
+		}
+	}
+}
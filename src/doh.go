@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// Longest DNS message
+const maxMsgSize = 65535
+
+// dohWriter collects the response of a DNS handler to a DNS-over-HTTPS
+// request (RFC 8484)
+type dohWriter struct {
+	local, remote net.Addr
+	// TSIG can't be verified here, so signed requests are handled as if
+	// their signature was bad
+	signed bool
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) Close() error         { return nil }
+func (w *dohWriter) TsigTimersOnly(bool)  {}
+func (w *dohWriter) Hijack()              {}
+
+func (w *dohWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(b), nil
+}
+
+func (w *dohWriter) TsigStatus() error {
+	if w.signed {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// getTCPAddr returns addr as a TCP address, so that the DNS handler neither
+// truncates nor rate limits the response as for UDP
+func getTCPAddr(addr string) net.Addr {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcpaddr
+}
+
+// getMinTTL returns the lowest TTL of the records in msg, to be used as the
+// lifetime of the HTTP response
+func getMinTTL(msg *dns.Msg) uint32 {
+	var minTTL uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return minTTL
+}
+
+// dohHandler answers DNS queries in HTTP GET and POST requests with the
+// handlers of the DNS server
+type dohHandler struct {
+	dns.Handler
+}
+
+func (h dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		b   []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(b)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	dw := &dohWriter{local: local, remote: getTCPAddr(r.RemoteAddr), signed: req.IsTsig() != nil}
+	h.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	resp, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", getMinTTL(dw.msg)))
+	w.Write(resp)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHHandler(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org", RecordTTL: 60})
+	if err := z.db.PutIPAddresses(context.Background(), "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	h := dohHandler{dns.HandlerFunc(z.handler)}
+
+	query := func(qname string, qtype uint16) []byte {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	get := func(b []byte) *http.Request {
+		return httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	}
+	post := func(b []byte, contentType string) *http.Request {
+		r := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+
+	tests := []struct {
+		name  string
+		req   *http.Request
+		code  int
+		rcode int
+		// Answers, and the Cache-Control header
+		answers      int
+		cacheControl string
+	}{
+		{"GET", get(query("a.example.org.", dns.TypeA)), http.StatusOK, dns.RcodeSuccess, 1, "max-age=60"},
+		{"POST", post(query("a.example.org.", dns.TypeA), "application/dns-message"), http.StatusOK,
+			dns.RcodeSuccess, 1, "max-age=60"},
+		{"nonexistent name", get(query("x.example.org.", dns.TypeA)), http.StatusOK, dns.RcodeNameError, 0,
+			"max-age=60"},
+		{"AXFR", get(query("example.org.", dns.TypeAXFR)), http.StatusOK, dns.RcodeRefused, 0, "max-age=0"},
+		{"POST of another type", post(query("a.example.org.", dns.TypeA), "text/plain"),
+			http.StatusUnsupportedMediaType, 0, 0, ""},
+		{"PUT", httptest.NewRequest("PUT", "/dns-query", nil), http.StatusMethodNotAllowed, 0, 0, ""},
+		{"bad base64", httptest.NewRequest("GET", "/dns-query?dns=!", nil), http.StatusBadRequest, 0, 0, ""},
+		{"bad message", get([]byte{0, 1, 2}), http.StatusBadRequest, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, tt.req)
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d; want %d", tt.name, w.Code, tt.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/dns-message" {
+			t.Errorf("%s: Content-Type = %q", tt.name, contentType)
+		}
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != tt.cacheControl {
+			t.Errorf("%s: Cache-Control = %q; want %q", tt.name, cacheControl, tt.cacheControl)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(w.Body.Bytes()); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if msg.Rcode != tt.rcode || len(msg.Answer) != tt.answers {
+			t.Errorf("%s: rcode = %s with %d answers; want %s with %d", tt.name, dns.RcodeToString[msg.Rcode],
+				len(msg.Answer), dns.RcodeToString[tt.rcode], tt.answers)
+		}
+	}
+}
+
+func TestGetMinTTL(t *testing.T) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 0}}
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		ttl  uint32
+	}{
+		{"empty", &dns.Msg{}, 0},
+		{"OPT only", &dns.Msg{Extra: []dns.RR{opt}}, 0},
+		{"answers", &dns.Msg{Answer: []dns.RR{
+			mustRR(t, "a.example.org. 300 A 192.0.2.1"),
+			mustRR(t, "a.example.org. 60 A 192.0.2.2"),
+		}}, 60},
+		{"authority", &dns.Msg{
+			Answer: []dns.RR{mustRR(t, "a.example.org. 300 A 192.0.2.1")},
+			Ns:     []dns.RR{mustRR(t, "example.org. 30 NS ns1.example.net.")},
+			Extra:  []dns.RR{opt},
+		}, 30},
+	}
+	for _, tt := range tests {
+		if ttl := getMinTTL(tt.msg); ttl != tt.ttl {
+			t.Errorf("%s: getMinTTL = %d; want %d", tt.name, ttl, tt.ttl)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Largest UDP payload we send, as recommended by DNS Flag Day 2020
+	// to avoid IP fragmentation
+	maxUDPSize = 1232
+
+	// Server cookies are in the interoperable format of RFC 9018
+	cookieVersion  = 1
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+)
+
+// cookieSecret is the key for the server cookies (RFC 7873) handed out
+type cookieSecret []byte
+
+func newCookieSecret() (cookieSecret, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// siphash returns the SipHash-2-4 of msg under the 16 byte key
+func siphash(key, msg []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	length := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		compress(binary.LittleEndian.Uint64(msg))
+	}
+	// The last block holds the remaining bytes and the length
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(length)
+	compress(binary.LittleEndian.Uint64(last[:]))
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// serverCookie returns the server cookie for a client cookie sent from ip at
+// the given time: version, three reserved bytes, timestamp and the SipHash-2-4
+// of the client cookie, these and the address (RFC 9018 section 4)
+func (secret cookieSecret) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, 16)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	msg := append(append(append([]byte(nil), client...), cookie[:8]...), ip...)
+	binary.LittleEndian.PutUint64(cookie[8:], siphash(secret, msg))
+	return cookie
+}
+
+// isValid reports whether server is a recent server cookie of ours
+// for the client cookie sent from ip
+func (secret cookieSecret) isValid(client, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != 16 || server[0] != cookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if now.Sub(issued) > cookieLifetime || issued.Sub(now) > cookieSkew {
+		return false
+	}
+	return subtle.ConstantTimeCompare(server, secret.serverCookie(client, ip, issued)) == 1
+}
+
+func getRemoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// getEdns0 returns the OPT record for the response to req, or nil if req has
+// none, along with the rcode to answer with instead of processing the query:
+// BADVERS for unsupported EDNS versions and FORMERR for malformed cookies.
+// It also reports whether req has a valid server cookie, which proves that
+// the client address is not spoofed.
+func getEdns0(req *dns.Msg, ip net.IP, secret cookieSecret) (*dns.OPT, int, bool) {
+	reqopt := req.IsEdns0()
+	if reqopt == nil {
+		return nil, dns.RcodeSuccess, false
+	}
+
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(maxUDPSize)
+	if reqopt.Do() {
+		// The client wants DNSSEC records, which are included if signing is enabled
+		opt.SetDo()
+	}
+
+	if reqopt.Version() != 0 {
+		return opt, dns.RcodeBadVers, false
+	}
+
+	for _, option := range reqopt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(cookie.Cookie)
+		// Client cookies are 8 bytes, server cookies 8 to 32
+		if err != nil || (len(b) != 8 && (len(b) < 16 || len(b) > 40)) {
+			return opt, dns.RcodeFormatError, false
+		}
+		client, server := b[:8], b[8:]
+		now := time.Now()
+		valid := secret.isValid(client, server, ip, now)
+		if !valid {
+			// Missing, expired or not ours: hand out a fresh one
+			server = secret.serverCookie(client, ip, now)
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(client) + hex.EncodeToString(server),
+		})
+		return opt, dns.RcodeSuccess, valid
+	}
+	return opt, dns.RcodeSuccess, false
+}
+
+// hasCookie tells whether opt holds a cookie for the client
+func hasCookie(opt *dns.OPT) bool {
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return true
+		}
+	}
+	return false
+}
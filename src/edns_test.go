@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSiphash(t *testing.T) {
+	// Test vectors of the SipHash reference implementation, for messages
+	// of 0 to 15 bytes 00 01 02 ... under the key 00 01 ... 0f
+	tests := []struct {
+		length int
+		want   uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+	}
+	key := mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f")
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for _, tt := range tests {
+		if got := siphash(key, msg[:tt.length]); got != tt.want {
+			t.Errorf("siphash of %d bytes = %x; want %x", tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	// RFC 9018 appendix A.1
+	secret := cookieSecret(mustDecodeHex(t, "e5e973e5a6b2a43f48e7dc849e37bfcf"))
+	client := mustDecodeHex(t, "2464c4abcf10c957")
+	ip := net.ParseIP("198.51.100.100")
+	issued := time.Unix(1559731985, 0)
+	want := mustDecodeHex(t, "010000005cf79f111f8130c3eee29480")
+	if got := secret.serverCookie(client, ip, issued); !bytes.Equal(got, want) {
+		t.Fatalf("serverCookie = %x; want %x", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		client []byte
+		ip     net.IP
+		now    time.Time
+		valid  bool
+	}{
+		{"fresh", client, ip, issued.Add(time.Minute), true},
+		{"expired", client, ip, issued.Add(cookieLifetime + time.Second), false},
+		{"from the future", client, ip, issued.Add(-cookieSkew - time.Second), false},
+		{"other address", client, net.ParseIP("198.51.100.101"), issued, false},
+		{"other client cookie", mustDecodeHex(t, "2464c4abcf10c958"), ip, issued, false},
+	}
+	for _, tt := range tests {
+		if valid := secret.isValid(tt.client, want, tt.ip, tt.now); valid != tt.valid {
+			t.Errorf("%s: isValid = %v; want %v", tt.name, valid, tt.valid)
+		}
+	}
+}
+
+func TestGetEdns0(t *testing.T) {
+	secret := cookieSecret(mustDecodeHex(t, "e5e973e5a6b2a43f48e7dc849e37bfcf"))
+	ip := net.ParseIP("198.51.100.100")
+	client := "2464c4abcf10c957"
+	server := hex.EncodeToString(secret.serverCookie(mustDecodeHex(t, client), ip, time.Now()))
+
+	tests := []struct {
+		name    string
+		edns    bool
+		version uint8
+		cookie  string
+		rcode   int
+		valid   bool
+		// Whether the response cookie is the request one
+		echoed bool
+	}{
+		{name: "no EDNS", rcode: dns.RcodeSuccess},
+		{name: "no cookie", edns: true, rcode: dns.RcodeSuccess},
+		{name: "bad version", edns: true, version: 1, rcode: dns.RcodeBadVers},
+		{name: "malformed cookie", edns: true, cookie: "2464c4abcf10", rcode: dns.RcodeFormatError},
+		{name: "client cookie", edns: true, cookie: client, rcode: dns.RcodeSuccess},
+		{name: "valid server cookie", edns: true, cookie: client + server, rcode: dns.RcodeSuccess, valid: true, echoed: true},
+		{name: "bad server cookie", edns: true, cookie: client + "0100000000000000000000000000000", rcode: dns.RcodeFormatError},
+		{name: "foreign server cookie", edns: true, cookie: client + "01000000000000000000000000000000", rcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		if tt.edns {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.SetVersion(tt.version)
+			if tt.cookie != "" {
+				opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: tt.cookie})
+			}
+		}
+
+		opt, rcode, valid := getEdns0(req, ip, secret)
+		if rcode != tt.rcode || valid != tt.valid {
+			t.Errorf("%s: rcode, valid = %s, %v; want %s, %v", tt.name,
+				dns.RcodeToString[rcode], valid, dns.RcodeToString[tt.rcode], tt.valid)
+		}
+		if (opt != nil) != tt.edns {
+			t.Errorf("%s: OPT = %v; want EDNS %v", tt.name, opt, tt.edns)
+		}
+		if rcode != dns.RcodeSuccess || tt.cookie == "" {
+			if hasCookie(opt) {
+				t.Errorf("%s: unexpected cookie in %v", tt.name, opt)
+			}
+			continue
+		}
+
+		var cookie string
+		for _, option := range opt.Option {
+			if c, ok := option.(*dns.EDNS0_COOKIE); ok {
+				cookie = c.Cookie
+			}
+		}
+		if cookie[:16] != client || len(cookie) != 48 {
+			t.Errorf("%s: cookie = %s; want client cookie %s and a server cookie", tt.name, cookie, client)
+		}
+		if echoed := cookie == tt.cookie; echoed != tt.echoed {
+			t.Errorf("%s: cookie %s echoed = %v; want %v", tt.name, cookie, echoed, tt.echoed)
+		}
+	}
+}
@@ -8,18 +8,41 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
 )
 
 const (
 	ipPrefix  = "IPS-"
 	txtPrefix = "TXT-"
 	crtPrefix = "CERT-"
+	rrPrefix  = "RR-"
+	// Followed by the view name and a dash
+	viewPrefix = "VIEW-"
+
+	serialName = "SERIAL"
 )
 
-type FileDatabase string
+// FileDatabase stores every value in a file of its own in a directory
+type FileDatabase struct {
+	dir string
+
+	// Index of the names with records and of their ancestors, so that
+	// DoesDomainExist needs no file reads. It is loaded on first use.
+	indexMu sync.Mutex
+	files   map[string]bool // names of the files holding records
+	names   map[string]int  // files by name
+	below   map[string]int  // names with files by ancestor
+}
+
+func NewFileDatabase(dir string) *FileDatabase {
+	return &FileDatabase{dir: dir}
+}
 
-func (db FileDatabase) getFile(ctx context.Context, name string) ([]byte, error) {
-	name = filepath.Join(string(db), name)
+func (db *FileDatabase) getFile(ctx context.Context, name string) ([]byte, error) {
+	name = filepath.Join(db.dir, name)
 	var (
 		data []byte
 		err  error
@@ -40,8 +63,8 @@ func (db FileDatabase) getFile(ctx context.Context, name string) ([]byte, error)
 	return data, err
 }
 
-func (db FileDatabase) putFile(ctx context.Context, name string, data []byte) error {
-	if err := os.MkdirAll(string(db), 0700); err != nil {
+func (db *FileDatabase) putFile(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(db.dir, 0700); err != nil {
 		return err
 	}
 
@@ -57,7 +80,7 @@ func (db FileDatabase) putFile(ctx context.Context, name string, data []byte) er
 		case <-ctx.Done():
 			// Don't overwrite the file if the context was canceled.
 		default:
-			newName := filepath.Join(string(db), name)
+			newName := filepath.Join(db.dir, name)
 			err = os.Rename(tmp, newName)
 		}
 	}()
@@ -66,17 +89,20 @@ func (db FileDatabase) putFile(ctx context.Context, name string, data []byte) er
 		return ctx.Err()
 	case <-done:
 	}
+	if err == nil {
+		db.indexFile(name, true)
+	}
 	return err
 }
 
-func (db FileDatabase) deleteFile(ctx context.Context, name string) error {
-	name = filepath.Join(string(db), name)
+func (db *FileDatabase) deleteFile(ctx context.Context, name string) error {
+	path := filepath.Join(db.dir, name)
 	var (
 		err  error
 		done = make(chan struct{})
 	)
 	go func() {
-		err = os.Remove(name)
+		err = os.Remove(path)
 		close(done)
 	}()
 	select {
@@ -87,13 +113,41 @@ func (db FileDatabase) deleteFile(ctx context.Context, name string) error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	db.indexFile(name, false)
 	return nil
 }
 
+func (db *FileDatabase) listFiles(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		names []string
+		err   error
+		done  = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		var infos []os.FileInfo
+		infos, err = ioutil.ReadDir(db.dir)
+		for _, fi := range infos {
+			if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), prefix) {
+				names = append(names, strings.TrimPrefix(fi.Name(), prefix))
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
 // writeTempFile writes b to a temporary file, closes the file and returns its path.
-func (db FileDatabase) writeTempFile(prefix string, b []byte) (string, error) {
+func (db *FileDatabase) writeTempFile(prefix string, b []byte) (string, error) {
 	// TempFile uses 0600 permissions
-	f, err := ioutil.TempFile(string(db), prefix)
+	f, err := ioutil.TempFile(db.dir, prefix)
 	if err != nil {
 		return "", err
 	}
@@ -126,29 +180,120 @@ func decodeFromGOB(b []byte, m interface{}) error {
 	return nil
 }
 
-func (db FileDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
-	var (
-		hasIP  bool
-		hasTXT bool
-	)
-
-	ipaddrs, err := db.GetIPAddresses(ctx, domain)
-	if err == nil {
-		hasIP = len(ipaddrs) > 0
-	} else {
+func (db *FileDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	if err := db.loadIndex(ctx); err != nil {
 		return false, err
 	}
+	// Empty non-terminals exist too
+	return db.names[domain] > 0 || db.below[domain] > 0, nil
+}
 
-	txtvals, err := db.GetTXTValues(ctx, domain)
-	if err == nil {
-		hasTXT = len(txtvals) > 0
+func getRecordPrefix(rrtype uint16) string {
+	return rrPrefix + dns.TypeToString[rrtype] + "-"
+}
+
+// getDomainPrefixes returns the prefixes of all files holding records
+func getDomainPrefixes() []string {
+	prefixes := []string{ipPrefix, txtPrefix}
+	for _, rrtype := range recordTypes {
+		prefixes = append(prefixes, getRecordPrefix(rrtype))
+	}
+	return prefixes
+}
+
+// loadIndex lists the files holding records into the index, unless it is
+// loaded already. Callers must hold db.indexMu.
+func (db *FileDatabase) loadIndex(ctx context.Context) error {
+	if db.files != nil {
+		return nil
+	}
+	db.files = make(map[string]bool)
+	db.names = make(map[string]int)
+	db.below = make(map[string]int)
+	for _, prefix := range getDomainPrefixes() {
+		names, err := db.listFiles(ctx, prefix)
+		if err != nil {
+			db.files = nil
+			return err
+		}
+		for _, name := range names {
+			db.addIndexFile(prefix+name, name)
+		}
+	}
+	return nil
+}
+
+// indexFile records in the index that the file called name now exists or
+// not, if it holds records and the index is loaded
+func (db *FileDatabase) indexFile(name string, exists bool) {
+	var domain string
+	for _, prefix := range getDomainPrefixes() {
+		if strings.HasPrefix(name, prefix) {
+			domain = strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+	if domain == "" {
+		return
+	}
+
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	if db.files == nil {
+		// Loading the index will find the file, or not
+		return
+	}
+	if exists {
+		db.addIndexFile(name, domain)
 	} else {
-		return false, err
+		db.removeIndexFile(name, domain)
+	}
+}
+
+// Callers of addIndexFile and removeIndexFile must hold db.indexMu
+func (db *FileDatabase) addIndexFile(name, domain string) {
+	if db.files[name] {
+		return
+	}
+	db.files[name] = true
+	db.names[domain]++
+	if db.names[domain] == 1 {
+		for _, ancestor := range getAncestors(domain) {
+			db.below[ancestor]++
+		}
+	}
+}
+
+func (db *FileDatabase) removeIndexFile(name, domain string) {
+	if !db.files[name] {
+		return
+	}
+	delete(db.files, name)
+	db.names[domain]--
+	if db.names[domain] == 0 {
+		delete(db.names, domain)
+		for _, ancestor := range getAncestors(domain) {
+			if db.below[ancestor]--; db.below[ancestor] == 0 {
+				delete(db.below, ancestor)
+			}
+		}
+	}
+}
+
+// getAncestors returns the names above domain, e.g. b.example.org, example.org
+// and org for a.b.example.org
+func getAncestors(domain string) []string {
+	var ancestors []string
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		ancestors = append(ancestors, domain)
 	}
-	return hasIP || hasTXT, nil
+	return ancestors
 }
 
-func (db FileDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+func (db *FileDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
 	var addresses []net.IP
 
 	bytes, err := db.getFile(ctx, ipPrefix+domain)
@@ -162,7 +307,7 @@ func (db FileDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net
 	return addresses, nil
 }
 
-func (db FileDatabase) PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error {
+func (db *FileDatabase) PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error {
 	bytes, err := encodeToGOB(addresses)
 	if err != nil {
 		return err
@@ -170,11 +315,41 @@ func (db FileDatabase) PutIPAddresses(ctx context.Context, domain string, addres
 	return db.putFile(ctx, ipPrefix+domain, bytes)
 }
 
-func (db FileDatabase) DeleteIPAddresses(ctx context.Context, domain string) error {
+func (db *FileDatabase) DeleteIPAddresses(ctx context.Context, domain string) error {
 	return db.deleteFile(ctx, ipPrefix+domain)
 }
 
-func (db FileDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
+func getViewFile(domain, view string) string {
+	return viewPrefix + view + "-" + domain
+}
+
+func (db *FileDatabase) GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error) {
+	var addresses []net.IP
+
+	bytes, err := db.getFile(ctx, getViewFile(domain, view))
+	if bytes == nil {
+		return nil, err
+	}
+	if err := decodeFromGOB(bytes, &addresses); err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+func (db *FileDatabase) PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error {
+	bytes, err := encodeToGOB(addresses)
+	if err != nil {
+		return err
+	}
+	return db.putFile(ctx, getViewFile(domain, view), bytes)
+}
+
+func (db *FileDatabase) DeleteViewAddresses(ctx context.Context, domain, view string) error {
+	return db.deleteFile(ctx, getViewFile(domain, view))
+}
+
+func (db *FileDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
 	var values []string
 
 	bytes, err := db.getFile(ctx, txtPrefix+domain)
@@ -188,7 +363,7 @@ func (db FileDatabase) GetTXTValues(ctx context.Context, domain string) ([]strin
 	return values, nil
 }
 
-func (db FileDatabase) PutTXTValues(ctx context.Context, domain string, values []string) error {
+func (db *FileDatabase) PutTXTValues(ctx context.Context, domain string, values []string) error {
 	bytes, err := encodeToGOB(values)
 	if err != nil {
 		return err
@@ -196,18 +371,92 @@ func (db FileDatabase) PutTXTValues(ctx context.Context, domain string, values [
 	return db.putFile(ctx, txtPrefix+domain, bytes)
 }
 
-func (db FileDatabase) DeleteTXTValues(ctx context.Context, domain string) error {
+func (db *FileDatabase) DeleteTXTValues(ctx context.Context, domain string) error {
 	return db.deleteFile(ctx, txtPrefix+domain)
 }
 
-func (db FileDatabase) GetCertificate(ctx context.Context, domain string) ([]byte, error) {
+func (db *FileDatabase) GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error) {
+	var values []string
+
+	bytes, err := db.getFile(ctx, getRecordPrefix(rrtype)+domain)
+	if bytes == nil {
+		return nil, err
+	}
+	if err := decodeFromGOB(bytes, &values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (db *FileDatabase) PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error {
+	bytes, err := encodeToGOB(values)
+	if err != nil {
+		return err
+	}
+	return db.putFile(ctx, getRecordPrefix(rrtype)+domain, bytes)
+}
+
+func (db *FileDatabase) DeleteRecords(ctx context.Context, domain string, rrtype uint16) error {
+	return db.deleteFile(ctx, getRecordPrefix(rrtype)+domain)
+}
+
+func (db *FileDatabase) GetCertificate(ctx context.Context, domain string) ([]byte, error) {
 	return db.getFile(ctx, crtPrefix+domain)
 }
 
-func (db FileDatabase) PutCertificate(ctx context.Context, domain string, data []byte) error {
+func (db *FileDatabase) PutCertificate(ctx context.Context, domain string, data []byte) error {
 	return db.putFile(ctx, crtPrefix+domain, data)
 }
 
-func (db FileDatabase) DeleteCertificate(ctx context.Context, domain string) error {
+func (db *FileDatabase) DeleteCertificate(ctx context.Context, domain string) error {
 	return db.deleteFile(ctx, crtPrefix+domain)
 }
+
+func (db *FileDatabase) ListCertificates(ctx context.Context) ([]string, error) {
+	return db.listFiles(ctx, crtPrefix)
+}
+
+func (db *FileDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	var serial uint32
+
+	bytes, err := db.getFile(ctx, serialName+"-"+zone)
+	if bytes == nil && err == nil {
+		// Continue from the serial number stored before there were zones
+		bytes, err = db.getFile(ctx, serialName)
+	}
+	if bytes == nil {
+		return 0, err
+	}
+	if err := decodeFromGOB(bytes, &serial); err != nil {
+		return 0, err
+	}
+
+	return serial, nil
+}
+
+func (db *FileDatabase) PutSerial(ctx context.Context, zone string, serial uint32) error {
+	bytes, err := encodeToGOB(serial)
+	if err != nil {
+		return err
+	}
+	return db.putFile(ctx, serialName+"-"+zone, bytes)
+}
+
+func (db *FileDatabase) ListDomains(ctx context.Context) ([]string, error) {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, prefix := range getDomainPrefixes() {
+		names, err := db.listFiles(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				domains = append(domains, name)
+			}
+		}
+	}
+	return domains, nil
+}
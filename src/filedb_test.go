@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFileDatabaseDomainExists(t *testing.T) {
+	dir := t.TempDir()
+	db := NewFileDatabase(dir)
+	ctx := context.Background()
+	// Written before and after the index is loaded
+	if err := db.PutIPAddresses(ctx, "a.b.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DoesDomainExist(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutTXTValues(ctx, "c.d.example.org", []string{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutRecords(ctx, "c.d.example.org", dns.TypeMX, []string{"10 mail.example.org."}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCertificate(ctx, "e.example.org", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		name   string
+		domain string
+		exists bool
+	}
+	check := func(db *FileDatabase, tests []test) {
+		for _, tt := range tests {
+			exists, err := db.DoesDomainExist(ctx, tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != tt.exists {
+				t.Errorf("%s: DoesDomainExist(%s) = %v; want %v", tt.name, tt.domain, exists, tt.exists)
+			}
+		}
+	}
+	tests := []test{
+		{"name", "a.b.example.org", true},
+		{"name with two types", "c.d.example.org", true},
+		{"empty non-terminal", "b.example.org", true},
+		{"apex", "example.org", true},
+		{"nonexistent name", "x.example.org", false},
+		{"below a name", "x.a.b.example.org", false},
+		{"certificate only", "e.example.org", false},
+	}
+	check(db, tests)
+	// A new database of the same directory loads the same index
+	check(NewFileDatabase(dir), tests)
+
+	// Names and their ancestors exist while any of their records do
+	if err := db.DeleteTXTValues(ctx, "c.d.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteIPAddresses(ctx, "a.b.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	tests = []test{
+		{"name with records left", "c.d.example.org", true},
+		{"deleted name", "a.b.example.org", false},
+		{"former empty non-terminal", "b.example.org", false},
+		{"apex", "example.org", true},
+	}
+	check(db, tests)
+	check(NewFileDatabase(dir), tests)
+}
+
+func TestFileDatabaseNameErrors(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	z.db = &serialDatabase{Database: NewFileDatabase(t.TempDir()), zone: "example.org", journal: z.journal}
+	z.serve()
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutIPAddresses(ctx, "b.c.example.org", []net.IP{net.ParseIP("192.0.2.2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"answer", "a.example.org.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"no data", "a.example.org.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{"empty non-terminal", "c.example.org.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"nonexistent name", "x.example.org.", dns.TypeA, dns.RcodeNameError, 0},
+		{"below a name", "x.a.example.org.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		msg := z.exchange(req, testTCPClient)
+		if msg.Rcode != tt.rcode || len(msg.Answer) != tt.answers {
+			t.Errorf("%s: rcode = %s with %d answers; want %s with %d", tt.name, dns.RcodeToString[msg.Rcode],
+				len(msg.Answer), dns.RcodeToString[tt.rcode], tt.answers)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthChecker probes the addresses of the configured hosts periodically,
+// so that addresses which don't accept connections are left out of answers
+type healthChecker struct {
+	db       Database
+	checks   []healthCheck
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.RWMutex
+	status map[string]map[string]bool // by host, then address
+}
+
+func newHealthChecker(db Database, config healthConfig) *healthChecker {
+	return &healthChecker{
+		db:       db,
+		checks:   config.Checks,
+		interval: time.Duration(config.Interval) * time.Second,
+		timeout:  time.Duration(config.Timeout) * time.Second,
+		status:   make(map[string]map[string]bool),
+	}
+}
+
+// run probes the hosts every interval, forever
+func (h *healthChecker) run() {
+	for {
+		for _, check := range h.checks {
+			h.probe(check)
+		}
+		time.Sleep(h.interval)
+	}
+}
+
+// probe connects to every address of the host of check in parallel, and
+// stores the results
+func (h *healthChecker) probe(check healthCheck) {
+	domain := getDomain(check.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ipaddrs, err := h.db.GetIPAddresses(ctx, domain)
+	cancel()
+	if err != nil {
+		fmt.Printf("Health check of %s failed with error: %v\n", domain, err)
+		return
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	status := make(map[string]bool)
+	for _, ip := range ipaddrs {
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+			ok := testTCPPort("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(check.Port)), h.timeout)
+			mu.Lock()
+			status[ip.String()] = ok
+			mu.Unlock()
+		}(ip)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr, ok := range status {
+		if was, known := h.status[domain][addr]; known && was != ok {
+			fmt.Printf("Health of %s at %s changed to %s\n", domain, addr, getHealthString(ok, true))
+		}
+	}
+	h.status[domain] = status
+}
+
+func getHealthString(healthy, known bool) string {
+	if !known {
+		return "unknown"
+	} else if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// get returns the health of addr of domain, and whether it has been probed
+func (h *healthChecker) get(domain string, addr net.IP) (bool, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	healthy, known := h.status[domain][addr.String()]
+	return healthy, known
+}
+
+// filter leaves the unhealthy addresses of domain out of ipaddrs. The
+// addresses of a family are all kept if none of them is healthy, so that
+// answers are never emptied by the checks.
+func (h *healthChecker) filter(domain string, ipaddrs []net.IP) []net.IP {
+	isHealthy := func(ip net.IP) bool {
+		healthy, known := h.get(domain, ip)
+		return healthy || !known
+	}
+	hasHealthy := make(map[bool]bool) // by isIPv4
+	for _, ip := range ipaddrs {
+		if isHealthy(ip) {
+			hasHealthy[isIPv4(ip)] = true
+		}
+	}
+
+	var filtered []net.IP
+	for _, ip := range ipaddrs {
+		if isHealthy(ip) || !hasHealthy[isIPv4(ip)] {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// healthDatabase wraps a Database and leaves unhealthy addresses out
+type healthDatabase struct {
+	Database
+	health *healthChecker
+}
+
+func (db *healthDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	ipaddrs, err := db.Database.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	return db.health.filter(domain, ipaddrs), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealthFilter(t *testing.T) {
+	h := newHealthChecker(&MemoryDatabase{}, healthConfig{})
+	h.status["a.example.org"] = map[string]bool{
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": false,
+		"2001:db8::2": false,
+	}
+	tests := []struct {
+		name    string
+		domain  string
+		ipaddrs []string
+		want    []string
+	}{
+		{"unhealthy dropped", "a.example.org", []string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1"}},
+		{"unknown kept", "a.example.org", []string{"192.0.2.2", "192.0.2.3"}, []string{"192.0.2.3"}},
+		{"all down", "a.example.org", []string{"2001:db8::1", "2001:db8::2"}, []string{"2001:db8::1", "2001:db8::2"}},
+		{"all of a family down", "a.example.org", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"},
+			[]string{"192.0.2.1", "2001:db8::1", "2001:db8::2"}},
+		{"not checked", "b.example.org", []string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}},
+	}
+	for _, tt := range tests {
+		var ipaddrs []net.IP
+		for _, addr := range tt.ipaddrs {
+			ipaddrs = append(ipaddrs, net.ParseIP(addr))
+		}
+		var filtered []string
+		for _, ip := range h.filter(tt.domain, ipaddrs) {
+			filtered = append(filtered, ip.String())
+		}
+		if !reflect.DeepEqual(filtered, tt.want) {
+			t.Errorf("%s: filter = %v; want %v", tt.name, filtered, tt.want)
+		}
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	ctx := context.Background()
+	// Nothing listens on 127.0.0.2 and 127.0.0.3
+	up := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+	down := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}
+	if err := z.db.PutIPAddresses(ctx, "up.example.org", up); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutIPAddresses(ctx, "down.example.org", down); err != nil {
+		t.Fatal(err)
+	}
+	config := healthConfig{Timeout: 1, Checks: []healthCheck{{"up.example.org", port}, {"down.example.org", port}}}
+	health := newHealthChecker(z.db, config)
+	for _, check := range config.Checks {
+		health.probe(check)
+	}
+	z.health = health
+	z.serve()
+
+	tests := []struct {
+		qname   string
+		answers []string
+		status  string
+	}{
+		{"up.example.org.", []string{"A 127.0.0.1"}, "127.0.0.1 healthy\n127.0.0.2 unhealthy\n"},
+		{"down.example.org.", []string{"A 127.0.0.2", "A 127.0.0.3"}, "127.0.0.2 unhealthy\n127.0.0.3 unhealthy\n"},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		msg := z.exchange(req, testUDPClient)
+		answers := getRecordStrings(msg.Answer)
+		sort.Strings(answers)
+		if !reflect.DeepEqual(answers, tt.answers) {
+			t.Errorf("%s: answers = %v; want %v", tt.qname, answers, tt.answers)
+		}
+
+		api := &API{db: z.db, health: health}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/health?hostname="+tt.qname[:len(tt.qname)-1], nil)
+		api.v1health(w, r, nil)
+		if body := w.Body.String(); body != tt.status {
+			t.Errorf("%s: status = %q; want %q", tt.qname, body, tt.status)
+		}
+	}
+
+	if _, known := health.get("up.example.org", net.ParseIP("127.0.0.9")); known {
+		t.Error("health of an address never probed is known")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// listeners holds the sockets of the servers, bound before the privileges
+// are dropped
+type listeners struct {
+	http   []net.Listener
+	https  []net.Listener
+	dnsUDP []net.PacketConn
+	dnsTCP []net.Listener
+	dot    []net.Listener
+}
+
+// getListenAddresses expands the addresses whose host is the name of a
+// network interface, e.g. "eth0:53", into the addresses of the interface
+func getListenAddresses(addrs []string) ([]string, error) {
+	var expanded []string
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		iface, err := net.InterfaceByName(host)
+		if host == "" || net.ParseIP(host) != nil || err != nil {
+			expanded = append(expanded, addr)
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ifaddr := range ifaddrs {
+			ipnet, ok := ifaddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.String()
+			if ipnet.IP.IsLinkLocalUnicast() && ipnet.IP.To4() == nil {
+				ip += "%" + iface.Name
+			}
+			expanded = append(expanded, net.JoinHostPort(ip, port))
+		}
+	}
+	return expanded, nil
+}
+
+// listen binds the sockets of the servers, or takes them from systemd
+func listen(config listenConfig, dot bool) (*listeners, error) {
+	if config.Systemd {
+		return getSystemdListeners()
+	}
+
+	ls := &listeners{}
+	bind := func(addrs []string, lns *[]net.Listener) error {
+		addrs, err := getListenAddresses(addrs)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			*lns = append(*lns, ln)
+		}
+		return nil
+	}
+	if err := bind(config.HTTP, &ls.http); err != nil {
+		return nil, err
+	}
+	if err := bind(config.HTTPS, &ls.https); err != nil {
+		return nil, err
+	}
+	if err := bind(config.DNS, &ls.dnsTCP); err != nil {
+		return nil, err
+	}
+	if dot {
+		if err := bind(config.DoT, &ls.dot); err != nil {
+			return nil, err
+		}
+	}
+
+	addrs, err := getListenAddresses(config.DNS)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ls.dnsUDP = append(ls.dnsUDP, pc)
+	}
+	return ls, nil
+}
+
+// getSystemdListeners returns the sockets passed by systemd, which are
+// named after the servers with FileDescriptorName= in the socket units
+func getSystemdListeners() (*listeners, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("bad LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The sockets are not for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	ls := &listeners{}
+	for i := 0; i < nfds; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, lnErr := net.FileListener(f)
+		var pc net.PacketConn
+		if lnErr != nil {
+			pc, err = net.FilePacketConn(f)
+		}
+		f.Close()
+		if lnErr != nil && err != nil {
+			return nil, fmt.Errorf("socket %s: %v", name, err)
+		}
+
+		switch {
+		case name == "dns" && pc != nil:
+			ls.dnsUDP = append(ls.dnsUDP, pc)
+		case name == "dns" && ln != nil:
+			ls.dnsTCP = append(ls.dnsTCP, ln)
+		case name == "http" && ln != nil:
+			ls.http = append(ls.http, ln)
+		case name == "https" && ln != nil:
+			ls.https = append(ls.https, ln)
+		case name == "dot" && ln != nil:
+			ls.dot = append(ls.dot, ln)
+		default:
+			return nil, fmt.Errorf("unexpected socket %s", name)
+		}
+	}
+	return ls, nil
+}
+
+// dropPrivileges switches to the configured user and group, if any
+func dropPrivileges(config listenConfig) error {
+	if config.User == "" {
+		return nil
+	}
+	u, err := user.Lookup(config.User)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if config.Group != "" {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	// The group first, as the user may not change it
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestGetListenAddresses(t *testing.T) {
+	// The loopback interface, whatever its name, expands to its addresses
+	var loName string
+	loAddrs := []string{":53"}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loName, loAddrs = iface.Name, nil
+		for _, ifaddr := range ifaddrs {
+			if ipnet, ok := ifaddr.(*net.IPNet); ok {
+				loAddrs = append(loAddrs, net.JoinHostPort(ipnet.IP.String(), "53"))
+			}
+		}
+		break
+	}
+
+	tests := []struct {
+		name  string
+		addrs []string
+		want  []string
+		err   bool
+	}{
+		{"addresses", []string{":53", "127.0.0.1:53", "[::1]:53"}, []string{":53", "127.0.0.1:53", "[::1]:53"}, false},
+		{"host name", []string{"localhost:53"}, []string{"localhost:53"}, false},
+		{"interface", []string{loName + ":53"}, loAddrs, false},
+		{"no port", []string{"127.0.0.1"}, nil, true},
+	}
+	for _, tt := range tests {
+		addrs, err := getListenAddresses(tt.addrs)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v; want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, tt.want) {
+			t.Errorf("%s: addresses = %v; want %v", tt.name, addrs, tt.want)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	config := listenConfig{
+		HTTP:  []string{"127.0.0.1:0"},
+		HTTPS: []string{"127.0.0.1:0"},
+		DNS:   []string{"127.0.0.1:0"},
+		DoT:   []string{"127.0.0.1:0"},
+	}
+	tests := []struct {
+		name string
+		dot  bool
+		// Number of http, https, DNS over UDP and TCP, and DoT sockets
+		counts [5]int
+	}{
+		{"without DoT", false, [5]int{1, 1, 1, 1, 0}},
+		{"with DoT", true, [5]int{1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		ls, err := listen(config, tt.dot)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		counts := [5]int{len(ls.http), len(ls.https), len(ls.dnsUDP), len(ls.dnsTCP), len(ls.dot)}
+		if counts != tt.counts {
+			t.Errorf("%s: sockets = %v; want %v", tt.name, counts, tt.counts)
+		}
+		for _, lns := range [][]net.Listener{ls.http, ls.https, ls.dnsTCP, ls.dot} {
+			for _, ln := range lns {
+				ln.Close()
+			}
+		}
+		for _, pc := range ls.dnsUDP {
+			pc.Close()
+		}
+	}
+
+	if _, err := listen(listenConfig{DNS: []string{"192.0.2.1"}}, false); err == nil {
+		t.Error("listen on an address without a port succeeded")
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/futurice/alley-oop/src/autocert"
+	"github.com/miekg/dns"
 )
 
 func fileExists(fname string) bool {
@@ -22,16 +27,173 @@ func getConfig(configFile string) AlleyOopConfig {
 		fmt.Printf("Configuration file %s invalid: %s\n", configFile, err)
 		os.Exit(1)
 	}
-	const MinimumTTL = 300 // Use a sane default/minimum value
-	if config.DNS.RecordTTL < MinimumTTL {
-		config.DNS.RecordTTL = MinimumTTL
+	setZoneDefaults(configFile, &config.DNS)
+	for i := range config.Zones {
+		setZoneDefaults(configFile, &config.Zones[i])
+	}
+	zones := getZones(config)
+	for i := range zones {
+		for _, other := range zones[:i] {
+			if dns.IsSubDomain(dns.Fqdn(other.Domain), dns.Fqdn(zones[i].Domain)) ||
+				dns.IsSubDomain(dns.Fqdn(zones[i].Domain), dns.Fqdn(other.Domain)) {
+				fmt.Printf("Configuration file %s invalid: zone %s overlaps zone %s\n", configFile, zones[i].Domain, other.Domain)
+				os.Exit(1)
+			}
+		}
+	}
+	if name, ok := getSharedKeyName(zones); ok {
+		fmt.Printf("Configuration file %s invalid: TSIG key %s used in two zones or with two secrets\n", configFile, name)
+		os.Exit(1)
+	}
+	if config.Server.Hostname == "" {
+		// Older configurations only name the server as the nameserver
+		config.Server.Hostname = config.DNS.NameServers[0]
+	}
+	for _, view := range config.Views {
+		if !viewnameRegexp.MatchString(view.Name) {
+			fmt.Printf("Configuration file %s invalid: bad view name %s\n", configFile, view.Name)
+			os.Exit(1)
+		}
+		for _, cidr := range view.Networks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				fmt.Printf("Configuration file %s invalid: bad network %s\n", configFile, cidr)
+				os.Exit(1)
+			}
+		}
+	}
+	for _, check := range config.Health.Checks {
+		if !hostnameRegexp.MatchString(getDomain(check.Name)) || check.Port <= 0 || check.Port > 65535 {
+			fmt.Printf("Configuration file %s invalid: bad health check %s:%d\n", configFile, check.Name, check.Port)
+			os.Exit(1)
+		}
+	}
+	if config.Health.Interval <= 0 {
+		config.Health.Interval = 30
+	}
+	if config.Health.Timeout <= 0 {
+		config.Health.Timeout = 5
+	}
+	if config.RateLimit.IPv4PrefixLength == 0 {
+		config.RateLimit.IPv4PrefixLength = 24
+	}
+	if config.RateLimit.IPv6PrefixLength == 0 {
+		config.RateLimit.IPv6PrefixLength = 56
+	}
+	if config.RateLimit.ResponsesPerSecond < 0 || config.RateLimit.Slip < 0 ||
+		config.RateLimit.IPv4PrefixLength > 32 || config.RateLimit.IPv6PrefixLength > 128 {
+		fmt.Printf("Configuration file %s invalid: bad rate limit\n", configFile)
+		os.Exit(1)
+	}
+	for _, cidr := range config.RateLimit.Exempt {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			fmt.Printf("Configuration file %s invalid: bad network %s\n", configFile, cidr)
+			os.Exit(1)
+		}
+	}
+	// The standard ports on all addresses by default
+	if config.Listen.HTTP == nil {
+		config.Listen.HTTP = []string{":80"}
+	}
+	if config.Listen.HTTPS == nil {
+		config.Listen.HTTPS = []string{":443"}
+	}
+	if config.Listen.DNS == nil {
+		config.Listen.DNS = []string{":53"}
+	}
+	if config.Listen.DoT == nil {
+		config.Listen.DoT = []string{":853"}
+	}
+	if output := config.Cert.Output; output != "" && output != "fullchain" && output != "chain" {
+		fmt.Printf("Configuration file %s invalid: bad certificate output %s\n", configFile, output)
+		os.Exit(1)
+	}
+	for _, cidr := range config.Server.TrustedResolvers {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			fmt.Printf("Configuration file %s invalid: bad network %s\n", configFile, cidr)
+			os.Exit(1)
+		}
+	}
+	for _, addr := range config.Server.Addresses {
+		if net.ParseIP(addr) == nil {
+			fmt.Printf("Configuration file %s invalid: bad server address %s\n", configFile, addr)
+			os.Exit(1)
+		}
 	}
 	return config
 }
 
+// setZoneDefaults checks the configuration of zone and fills in defaults
+func setZoneDefaults(configFile string, zone *dnsConfig) {
+	if zone.Domain == "" || len(zone.NameServers) == 0 {
+		fmt.Printf("Configuration file %s invalid: zone without domain or nameservers\n", configFile)
+		os.Exit(1)
+	}
+	const MinimumTTL = 300 // Use a sane default/minimum value
+	if zone.RecordTTL < MinimumTTL {
+		zone.RecordTTL = MinimumTTL
+	}
+	for _, cidr := range zone.SynthesizeNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			fmt.Printf("Configuration file %s invalid: bad network %s\n", configFile, cidr)
+			os.Exit(1)
+		}
+	}
+	for _, cidr := range zone.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			fmt.Printf("Configuration file %s invalid: bad network %s\n", configFile, cidr)
+			os.Exit(1)
+		}
+	}
+	if zone.NsAdmin == "" {
+		zone.NsAdmin = "hostmaster." + zone.Domain
+	}
+	// Defaults for the SOA timers as recommended by RIPE-203
+	if zone.Refresh == 0 {
+		zone.Refresh = 86400
+	}
+	if zone.Retry == 0 {
+		zone.Retry = 7200
+	}
+	if zone.Expire == 0 {
+		zone.Expire = 3600000
+	}
+	if zone.Minimum == 0 {
+		zone.Minimum = zone.RecordTTL
+	}
+}
+
+// printDS prints the DNSKEY and DS records of the zone, generating the key if
+// needed, so that the DS record can be published at the parent zone
+func printDS(db Database, config dnsConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	signer, err := getZoneSigner(ctx, db, dns.Fqdn(config.Domain), config.RecordTTL)
+	if err != nil {
+		fmt.Printf("Loading the DNSSEC key failed with error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(signer.dnskey)
+	fmt.Println(signer.ds())
+}
+
+// getServerCertificate returns the certificates of m for the hostname of the
+// server only, so that TLS clients can't have certificates issued for other
+// names. Resolvers often connect over DNS-over-TLS by address, without SNI.
+func getServerCertificate(m *autocert.Manager, hostname string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = hostname
+		}
+		if !strings.EqualFold(strings.TrimSuffix(hello.ServerName, "."), hostname) {
+			return nil, fmt.Errorf("host %q is not the server", hello.ServerName)
+		}
+		return m.GetCertificate(hello)
+	}
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s <config>\n", os.Args[0])
+	if len(os.Args) != 2 && !(len(os.Args) == 3 && os.Args[2] == "ds") {
+		fmt.Printf("Usage: %s <config> [ds]\n", os.Args[0])
 		os.Exit(1)
 	}
 	configFile := os.Args[1]
@@ -42,21 +204,59 @@ func main() {
 
 	config := getConfig(configFile)
 
-	db := FileDatabase(config.DB.Directory)
-	api := NewAPI(config.Auth, db)
-	handler := api.Handler
+	filedb := NewFileDatabase(config.DB.Directory)
+	var zones []dnsZone
+	zonedbs := make(map[string]Database)
+	for _, zoneConfig := range getZones(config) {
+		zone := getDomain(zoneConfig.Domain)
+		journal := newZoneJournal()
+		db := &cachedDatabase{Database: &serialDatabase{Database: filedb, zone: zone, journal: journal}}
+		zones = append(zones, dnsZone{config: zoneConfig, db: db, journal: journal})
+		zonedbs[zone] = db
+	}
+	db := &zonedDatabase{Database: zones[0].db, zones: zonedbs}
+	if len(os.Args) == 3 {
+		for _, zone := range zones {
+			printDS(zone.db, zone.config)
+		}
+		return
+	}
 
-	// FIXME: We should have the host somewhere explicitly
-	hostname := config.DNS.NameServers[0]
-	m := autocert.Manager{
-		Cache:      dbCertCache{db},
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(hostname),
+	// Bind the sockets while still privileged
+	ls, err := listen(config.Listen, config.Server.DNSOverTLS)
+	if err != nil {
+		fmt.Printf("Binding the sockets failed with error: %v\n", err)
+		os.Exit(1)
 	}
+	if err := dropPrivileges(config.Listen); err != nil {
+		fmt.Printf("Dropping privileges failed with error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var health *healthChecker
+	if len(config.Health.Checks) > 0 {
+		health = newHealthChecker(db, config.Health)
+		go health.run()
+	}
+
+	api := NewAPI(config.Auth, config.Cert, db, getZones(config), config.Views, health)
+	handler := api.Handler
+	go api.RenewCachedCertificates()
+
+	// The certificate of the server comes from the manager of the API, so
+	// that both share the budget and the renewals
+	hostname := config.Server.Hostname
+	getCertificate := getServerCertificate(api.certmgr, hostname)
 
 	cfg := &tls.Config{
 		MinVersion:     tls.VersionTLS12,
-		GetCertificate: m.GetCertificate,
+		GetCertificate: getCertificate,
+	}
+	if config.Server.DNSOverHTTPS {
+		mux := http.NewServeMux()
+		mux.Handle("/dns-query", dohHandler{dns.DefaultServeMux})
+		mux.Handle("/", handler)
+		handler = mux
 	}
 	srv := &http.Server{
 		TLSConfig: cfg,
@@ -65,16 +265,40 @@ func main() {
 
 	fmt.Printf("Starting alley-oop v2.0.0\n")
 
-	go func() {
-		certHandler := m.HTTPHandler(nil)
-		fmt.Printf("Starting server at http://localhost:80\n")
-		log.Fatal(http.ListenAndServe(":80", certHandler))
-	}()
+	certHandler := api.certmgr.HTTPHandler(nil)
+	for _, ln := range ls.http {
+		go func(ln net.Listener) {
+			fmt.Printf("Starting server at http://%s\n", ln.Addr())
+			log.Fatal(http.Serve(ln, certHandler))
+		}(ln)
+	}
 
-	go func() {
-		startDNS(db, config.DNS)
-	}()
+	if config.Cert.CAAIssuer != "" {
+		for _, zone := range zones {
+			go publishCAA(zone.db, getDomain(zone.config.Domain), api.certmgr.AccountURI, config.Cert)
+		}
+	}
+
+	var limiter *rateLimiter
+	if config.RateLimit.ResponsesPerSecond > 0 {
+		limiter = newRateLimiter(config.RateLimit)
+	}
 
-	fmt.Printf("Starting server at http://localhost:443\n")
-	log.Fatal(srv.ListenAndServeTLS("", ""))
+	var dotConfig *tls.Config
+	if config.Server.DNSOverTLS {
+		dotConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getCertificate,
+		}
+	}
+
+	startDNS(zones, config.Server, getViews(config.Views), health, limiter, ls, dotConfig)
+
+	for _, ln := range ls.https {
+		go func(ln net.Listener) {
+			fmt.Printf("Starting server at https://%s\n", ln.Addr())
+			log.Fatal(srv.ServeTLS(ln, "", ""))
+		}(ln)
+	}
+	select {}
 }
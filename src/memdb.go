@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"net"
+	"strings"
 	"sync"
 )
 
 type MemoryDatabase struct {
 	sync.RWMutex
 	ipaddrs  map[string][]net.IP
+	viewips  map[string]map[string][]net.IP // by view, then domain
 	txtvals  map[string][]string
+	records  map[string]map[uint16][]string
 	certdata map[string][]byte
+	serials  map[string]uint32
 }
 
 func (db *MemoryDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
@@ -22,7 +26,33 @@ func (db *MemoryDatabase) DoesDomainExist(ctx context.Context, domain string) (b
 	if err != nil {
 		return false, err
 	}
-	return (len(ipaddrs) > 0 || len(txtvals) > 0), nil
+	if len(ipaddrs) > 0 || len(txtvals) > 0 {
+		return true, nil
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	if len(db.records[domain]) > 0 {
+		return true, nil
+	}
+
+	// Empty non-terminals exist too
+	for name := range db.ipaddrs {
+		if strings.HasSuffix(name, "."+domain) {
+			return true, nil
+		}
+	}
+	for name := range db.txtvals {
+		if strings.HasSuffix(name, "."+domain) {
+			return true, nil
+		}
+	}
+	for name := range db.records {
+		if strings.HasSuffix(name, "."+domain) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (db *MemoryDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
@@ -48,6 +78,32 @@ func (db *MemoryDatabase) DeleteIPAddresses(ctx context.Context, domain string)
 	return nil
 }
 
+func (db *MemoryDatabase) GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.viewips[view][domain], nil
+}
+
+func (db *MemoryDatabase) PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.viewips == nil {
+		db.viewips = make(map[string]map[string][]net.IP)
+	}
+	if db.viewips[view] == nil {
+		db.viewips[view] = make(map[string][]net.IP)
+	}
+	db.viewips[view][domain] = addresses
+	return nil
+}
+
+func (db *MemoryDatabase) DeleteViewAddresses(ctx context.Context, domain, view string) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.viewips[view], domain)
+	return nil
+}
+
 func (db *MemoryDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
 	db.RLock()
 	defer db.RUnlock()
@@ -71,6 +127,35 @@ func (db *MemoryDatabase) DeleteTXTValues(ctx context.Context, domain string) er
 	return nil
 }
 
+func (db *MemoryDatabase) GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.records[domain][rrtype], nil
+}
+
+func (db *MemoryDatabase) PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.records == nil {
+		db.records = make(map[string]map[uint16][]string)
+	}
+	if db.records[domain] == nil {
+		db.records[domain] = make(map[uint16][]string)
+	}
+	db.records[domain][rrtype] = values
+	return nil
+}
+
+func (db *MemoryDatabase) DeleteRecords(ctx context.Context, domain string, rrtype uint16) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.records[domain], rrtype)
+	if len(db.records[domain]) == 0 {
+		delete(db.records, domain)
+	}
+	return nil
+}
+
 func (db *MemoryDatabase) GetCertificate(ctx context.Context, domain string) ([]byte, error) {
 	db.RLock()
 	defer db.RUnlock()
@@ -93,3 +178,51 @@ func (db *MemoryDatabase) DeleteCertificate(ctx context.Context, domain string)
 	delete(db.certdata, domain)
 	return nil
 }
+
+func (db *MemoryDatabase) ListCertificates(ctx context.Context) ([]string, error) {
+	db.RLock()
+	defer db.RUnlock()
+	var names []string
+	for name := range db.certdata {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (db *MemoryDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.serials[zone], nil
+}
+
+func (db *MemoryDatabase) PutSerial(ctx context.Context, zone string, serial uint32) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.serials == nil {
+		db.serials = make(map[string]uint32)
+	}
+	db.serials[zone] = serial
+	return nil
+}
+
+func (db *MemoryDatabase) ListDomains(ctx context.Context) ([]string, error) {
+	db.RLock()
+	defer db.RUnlock()
+	var domains []string
+	for name := range db.ipaddrs {
+		domains = append(domains, name)
+	}
+	for name := range db.txtvals {
+		if _, ok := db.ipaddrs[name]; !ok {
+			domains = append(domains, name)
+		}
+	}
+	for name := range db.records {
+		_, hasIP := db.ipaddrs[name]
+		_, hasTXT := db.txtvals[name]
+		if !hasIP && !hasTXT {
+			domains = append(domains, name)
+		}
+	}
+	return domains, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Record types stored as RDATA in presentation format, besides the
+// addresses and TXT values which have methods of their own
+var recordTypes = []uint16{dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeCAA, dns.TypePTR}
+
+// Longest chain of CNAMEs followed within the zone
+const maxCNAMEChain = 8
+
+var errHasCNAME = errors.New("name has a CNAME record")
+
+func isRecordType(rrtype uint16) bool {
+	for _, t := range recordTypes {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func getRecords(fqdn string, recordTTL int, rrtype uint16, values []string) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, val := range values {
+		str := fmt.Sprintf("%s %d IN %s %s", fqdn, recordTTL, dns.TypeToString[rrtype], val)
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+// getRecordValue parses value as the RDATA of a record of type rrtype, and
+// returns it in the form stored in the database. Relative names in value
+// are taken to be fully qualified.
+func getRecordValue(rrtype uint16, value string) (string, error) {
+	rr, err := dns.NewRR(fmt.Sprintf(". IN %s %s", dns.TypeToString[rrtype], value))
+	if err != nil {
+		return "", err
+	}
+	if rr == nil {
+		return "", fmt.Errorf("empty %s record", dns.TypeToString[rrtype])
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String()), nil
+}
+
+// getAllRecords returns the records of all types stored in the database
+// at domain, apart from the addresses and TXT values
+func getAllRecords(ctx context.Context, db Database, domain string, recordTTL int) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, rrtype := range recordTypes {
+		values, err := db.GetRecords(ctx, domain, rrtype)
+		if err != nil {
+			return nil, err
+		}
+		rrs, err := getRecords(dns.Fqdn(domain), recordTTL, rrtype, values)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rrs...)
+	}
+	return records, nil
+}
+
+// checkCNAME returns an error if values can't be stored as the records of
+// type rrtype at domain, as a CNAME record must be the only record of its
+// name (RFC 1034 section 3.6.2). The addresses of views count as records.
+func checkCNAME(ctx context.Context, db Database, domain string, rrtype uint16, values []string, views []string) error {
+	if rrtype != dns.TypeCNAME {
+		cnames, err := db.GetRecords(ctx, domain, dns.TypeCNAME)
+		if err != nil {
+			return err
+		}
+		if len(cnames) > 0 {
+			return errHasCNAME
+		}
+		return nil
+	}
+
+	if len(values) > 1 {
+		return errors.New("name can have only one CNAME record")
+	}
+	ipaddrs, err := db.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		viewips, err := db.GetViewAddresses(ctx, domain, view)
+		if err != nil {
+			return err
+		}
+		ipaddrs = append(ipaddrs, viewips...)
+	}
+	txtvals, err := db.GetTXTValues(ctx, domain)
+	if err != nil {
+		return err
+	}
+	records, err := getAllRecords(ctx, db, domain, 0)
+	if err != nil {
+		return err
+	}
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeCNAME {
+			return errors.New("name has other records than CNAME")
+		}
+	}
+	if len(ipaddrs) > 0 || len(txtvals) > 0 {
+		return errors.New("name has other records than CNAME")
+	}
+	return nil
+}
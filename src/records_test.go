@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newRecordsDatabase returns a database with a record of every kind
+func newRecordsDatabase(t *testing.T) Database {
+	db := &MemoryDatabase{}
+	ctx := context.Background()
+	ip := []net.IP{net.ParseIP("192.0.2.1")}
+	for _, err := range []error{
+		db.PutIPAddresses(ctx, "a.example.org", ip),
+		db.PutViewAddresses(ctx, "v.example.org", "lan", ip),
+		db.PutTXTValues(ctx, "t.example.org", []string{`"v"`}),
+		db.PutRecords(ctx, "m.example.org", dns.TypeMX, []string{"10 mail.example.org."}),
+		db.PutRecords(ctx, "c.example.org", dns.TypeCNAME, []string{"a.example.org."}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestCheckCNAME(t *testing.T) {
+	db := newRecordsDatabase(t)
+	tests := []struct {
+		name   string
+		domain string
+		rrtype uint16
+		values []string
+		views  []string
+		ok     bool
+	}{
+		{"CNAME", "n.example.org", dns.TypeCNAME, []string{"a.example.org."}, nil, true},
+		{"replace a CNAME", "c.example.org", dns.TypeCNAME, []string{"m.example.org."}, nil, true},
+		{"two CNAMEs", "n.example.org", dns.TypeCNAME, []string{"a.example.org.", "m.example.org."}, nil, false},
+		{"CNAME next to addresses", "a.example.org", dns.TypeCNAME, []string{"c.example.org."}, nil, false},
+		{"CNAME next to TXT", "t.example.org", dns.TypeCNAME, []string{"c.example.org."}, nil, false},
+		{"CNAME next to MX", "m.example.org", dns.TypeCNAME, []string{"c.example.org."}, nil, false},
+		{"CNAME next to view addresses", "v.example.org", dns.TypeCNAME, []string{"a.example.org."}, []string{"lan"}, false},
+		{"CNAME next to addresses of no view", "v.example.org", dns.TypeCNAME, []string{"a.example.org."}, nil, true},
+		{"addresses next to a CNAME", "c.example.org", dns.TypeA, nil, nil, false},
+		{"TXT next to a CNAME", "c.example.org", dns.TypeTXT, nil, nil, false},
+		{"MX next to a CNAME", "c.example.org", dns.TypeMX, []string{"10 mail.example.org."}, nil, false},
+		{"MX", "m.example.org", dns.TypeMX, []string{"20 mx.example.org."}, nil, true},
+	}
+	for _, tt := range tests {
+		err := checkCNAME(context.Background(), db, tt.domain, tt.rrtype, tt.values, tt.views)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkCNAME = %v; want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.rrtype != dns.TypeCNAME && !tt.ok && err != errHasCNAME {
+			t.Errorf("%s: checkCNAME = %v; want %v", tt.name, err, errHasCNAME)
+		}
+	}
+}
+
+func TestV1Records(t *testing.T) {
+	db := newRecordsDatabase(t)
+	api := &API{db: db, zones: []dnsConfig{{Domain: "example.org"}}, views: map[string]bool{"lan": true}}
+	tests := []struct {
+		method string
+		query  string
+		code   int
+		body   string
+	}{
+		{"GET", "hostname=m.example.org&type=MX", http.StatusOK, "10 mail.example.org.\n"},
+		{"PUT", "hostname=n.example.org&type=CNAME&value=a.example.org", http.StatusOK, "good\n"},
+		{"GET", "hostname=n.example.org&type=cname", http.StatusOK, "a.example.org.\n"},
+		{"PUT", "hostname=example.org&type=CNAME&value=a.example.org", http.StatusConflict, ""},
+		{"PUT", "hostname=a.example.org&type=CNAME&value=n.example.org", http.StatusConflict, ""},
+		{"PUT", "hostname=v.example.org&type=CNAME&value=n.example.org", http.StatusConflict, ""},
+		{"PUT", "hostname=c.example.org&type=MX&value=10+mail.example.org", http.StatusConflict, ""},
+		{"PUT", "hostname=m.example.org&type=MX&value=10+mail", http.StatusOK, "good\n"},
+		{"GET", "hostname=m.example.org&type=MX", http.StatusOK, "10 mail.\n"},
+		{"PUT", "hostname=m.example.org&type=MX&value=mail", http.StatusBadRequest, ""},
+		{"PUT", "hostname=m.example.org&type=A&value=192.0.2.1", http.StatusBadRequest, ""},
+		{"PUT", "hostname=m.example.com&type=MX&value=10+mail.example.org", http.StatusBadRequest, ""},
+		{"DELETE", "hostname=m.example.org&type=MX", http.StatusOK, "good\n"},
+		{"GET", "hostname=m.example.org&type=MX", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/v1/records?"+tt.query, nil)
+		api.v1records(w, r, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: status = %d; want %d", tt.method, tt.query, w.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && w.Body.String() != tt.body {
+			t.Errorf("%s %s: body = %q; want %q", tt.method, tt.query, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestGetRecordValue(t *testing.T) {
+	tests := []struct {
+		rrtype uint16
+		value  string
+		want   string // "" if invalid
+	}{
+		{dns.TypeCNAME, "a.example.org", "a.example.org."},
+		{dns.TypeMX, "10 Mail.Example.org.", "10 Mail.Example.org."},
+		{dns.TypeSRV, "0 5 1883 mqtt.example.org", "0 5 1883 mqtt.example.org."},
+		{dns.TypeCAA, `0 issue "letsencrypt.org"`, `0 issue "letsencrypt.org"`},
+		{dns.TypeMX, "mail.example.org", ""},
+		{dns.TypeMX, "", ""},
+	}
+	for _, tt := range tests {
+		value, err := getRecordValue(tt.rrtype, tt.value)
+		if err != nil {
+			value = ""
+		}
+		if value != tt.want {
+			t.Errorf("getRecordValue(%s, %q) = %q, %v; want %q", dns.TypeToString[tt.rrtype], tt.value, value, err,
+				tt.want)
+		}
+	}
+}
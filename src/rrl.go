@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bound the memory used by spoofed client addresses
+const maxRateEntries = 100000
+
+// Responses dropped or slipped (sent truncated) by response rate limiting
+var (
+	rrlDropped = expvar.NewInt("dnsRateLimitDropped")
+	rrlSlipped = expvar.NewInt("dnsRateLimitSlipped")
+)
+
+// Actions for a response
+const (
+	rrlSend = iota
+	rrlSlip
+	rrlDrop
+)
+
+// Kinds of responses, limited separately as in BIND
+const (
+	rrlAnswer = iota
+	rrlNoData
+	rrlNXDomain
+	rrlError
+)
+
+type rateKey struct {
+	prefix string
+	kind   int
+	name   string
+}
+
+type rateEntry struct {
+	key     rateKey
+	tokens  float64
+	last    time.Time
+	limited int // responses over the limit, to pick those slipped
+}
+
+// rateLimiter limits the UDP responses to client networks (RFC 5358 section
+// 4, and the RRL scheme of BIND), so that the server is no good for
+// reflection attacks with spoofed source addresses. Responses over the limit
+// are dropped, but every slip-th is sent truncated, so that real clients
+// behind the network can retry over TCP.
+type rateLimiter struct {
+	rate   float64
+	slip   int
+	masks  [2]net.IPMask // IPv4, IPv6
+	exempt []*net.IPNet
+
+	mu      sync.Mutex
+	entries map[rateKey]*list.Element // into order
+	order   *list.List                // entries, the least recently used first
+}
+
+func newRateLimiter(config rateLimitConfig) *rateLimiter {
+	l := &rateLimiter{
+		rate:  float64(config.ResponsesPerSecond),
+		slip:  config.Slip,
+		masks: [2]net.IPMask{net.CIDRMask(config.IPv4PrefixLength, 32), net.CIDRMask(config.IPv6PrefixLength, 128)},
+	}
+	for _, cidr := range config.Exempt {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			l.exempt = append(l.exempt, network)
+		}
+	}
+	return l
+}
+
+// getRateKey returns the key of the response msg to ip. Positive answers
+// are counted per name, the others per zone, so that random names don't
+// get around the limit.
+func (l *rateLimiter) getRateKey(ip net.IP, msg *dns.Msg, zone string) rateKey {
+	var prefix net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix = ip4.Mask(l.masks[0])
+	} else {
+		prefix = ip.Mask(l.masks[1])
+	}
+
+	key := rateKey{prefix: prefix.String(), name: zone}
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		key.kind = rrlNXDomain
+	case msg.Rcode != dns.RcodeSuccess:
+		key.kind = rrlError
+	case len(msg.Answer) == 0:
+		key.kind = rrlNoData
+	default:
+		key.kind = rrlAnswer
+		if len(msg.Question) > 0 {
+			key.name = strings.ToLower(msg.Question[0].Name)
+		}
+	}
+	return key
+}
+
+// check returns the action for the response msg to ip
+func (l *rateLimiter) check(ip net.IP, msg *dns.Msg, zone string) int {
+	for _, network := range l.exempt {
+		if network.Contains(ip) {
+			return rrlSend
+		}
+	}
+
+	key := l.getRateKey(ip, msg, zone)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries == nil {
+		l.entries = make(map[rateKey]*list.Element)
+		l.order = list.New()
+	}
+	var entry *rateEntry
+	if e, ok := l.entries[key]; ok {
+		entry = e.Value.(*rateEntry)
+		l.order.MoveToBack(e)
+	} else {
+		if l.order.Len() >= maxRateEntries {
+			// Evict the entry used the longest ago, whose bucket is
+			// the most likely to be full again anyway
+			oldest := l.order.Front()
+			l.order.Remove(oldest)
+			delete(l.entries, oldest.Value.(*rateEntry).key)
+		}
+		entry = &rateEntry{key: key, tokens: l.rate, last: now}
+		l.entries[key] = l.order.PushBack(entry)
+	}
+
+	// Refill the bucket, holding at most one second of responses
+	entry.tokens += now.Sub(entry.last).Seconds() * l.rate
+	if entry.tokens > l.rate {
+		entry.tokens = l.rate
+	}
+	entry.last = now
+	if entry.tokens >= 1 {
+		entry.tokens--
+		entry.limited = 0
+		return rrlSend
+	}
+
+	entry.limited++
+	if l.slip > 0 && entry.limited%l.slip == 0 {
+		rrlSlipped.Add(1)
+		return rrlSlip
+	}
+	rrlDropped.Add(1)
+	return rrlDrop
+}
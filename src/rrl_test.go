@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetRateKey(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{ResponsesPerSecond: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+	answer := func(qname string, rcode int, answers int) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, dns.TypeA)
+		msg.Rcode = rcode
+		for i := 0; i < answers; i++ {
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET}})
+		}
+		return msg
+	}
+	tests := []struct {
+		name string
+		ip   string
+		msg  *dns.Msg
+		key  rateKey
+	}{
+		{"answer", "192.0.2.7", answer("A.example.org.", dns.RcodeSuccess, 1),
+			rateKey{prefix: "192.0.2.0", kind: rrlAnswer, name: "a.example.org."}},
+		{"no data", "192.0.2.7", answer("a.example.org.", dns.RcodeSuccess, 0),
+			rateKey{prefix: "192.0.2.0", kind: rrlNoData, name: "example.org."}},
+		{"nonexistent name", "192.0.2.7", answer("x.example.org.", dns.RcodeNameError, 0),
+			rateKey{prefix: "192.0.2.0", kind: rrlNXDomain, name: "example.org."}},
+		{"error", "192.0.2.7", answer("a.example.org.", dns.RcodeRefused, 0),
+			rateKey{prefix: "192.0.2.0", kind: rrlError, name: "example.org."}},
+		{"IPv6", "2001:db8:0:1ff::1", answer("a.example.org.", dns.RcodeSuccess, 1),
+			rateKey{prefix: "2001:db8:0:100::", kind: rrlAnswer, name: "a.example.org."}},
+	}
+	for _, tt := range tests {
+		if key := l.getRateKey(net.ParseIP(tt.ip), tt.msg, "example.org."); key != tt.key {
+			t.Errorf("%s: key = %+v; want %+v", tt.name, key, tt.key)
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	limiter := newRateLimiter(rateLimitConfig{
+		ResponsesPerSecond: 1,
+		Slip:               2,
+		IPv4PrefixLength:   24,
+		IPv6PrefixLength:   56,
+		Exempt:             []string{"198.51.101.0/24"},
+	})
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	z.limiter = limiter
+	z.serve()
+	if err := z.db.PutIPAddresses(context.Background(), "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	const clientCookie = "0123456789abcdef"
+	var (
+		limited   = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+		exempt    = &net.UDPAddr{IP: net.ParseIP("198.51.101.1"), Port: 5353}
+		cookies   = &net.UDPAddr{IP: net.ParseIP("198.51.102.1"), Port: 5353}
+		tcpClient = &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+		// Last cookie answered to the cookies client
+		serverCookie string
+	)
+	// The rate is one response per second, so the steps are far quicker
+	// than the bucket refills
+	tests := []struct {
+		name   string
+		remote net.Addr
+		// Cookie sent: "" for none, "client" for a client cookie only,
+		// "server" for the last one answered
+		cookie string
+		// "answer", "drop", "truncated" or "badcookie"
+		action string
+	}{
+		{"first", limited, "", "answer"},
+		{"over the limit", limited, "", "drop"},
+		{"slip", limited, "", "truncated"},
+		{"dropped again", limited, "", "drop"},
+		{"over TCP", tcpClient, "", "answer"},
+		{"exempt", exempt, "", "answer"},
+		{"exempt again", exempt, "", "answer"},
+		{"cookie", cookies, "client", "answer"},
+		{"cookie over the limit", cookies, "client", "drop"},
+		{"cookie slip", cookies, "client", "badcookie"},
+		{"server cookie", cookies, "server", "answer"},
+		{"server cookie again", cookies, "server", "answer"},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.org.", dns.TypeA)
+		if tt.cookie != "" {
+			cookie := clientCookie
+			if tt.cookie == "server" {
+				cookie = serverCookie
+			}
+			req.SetEdns0(1232, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+
+		msg := z.exchange(req, tt.remote)
+		var action string
+		switch {
+		case msg == nil:
+			action = "drop"
+		case msg.Truncated:
+			action = "truncated"
+		case msg.Rcode == dns.RcodeBadCookie:
+			action = "badcookie"
+		case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+			action = "answer"
+		default:
+			action = dns.RcodeToString[msg.Rcode]
+		}
+		if action != tt.action {
+			t.Errorf("%s: action = %s; want %s", tt.name, action, tt.action)
+		}
+		if msg != nil && tt.remote == cookies {
+			if opt := msg.IsEdns0(); opt != nil {
+				for _, option := range opt.Option {
+					if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+						serverCookie = cookie.Cookie
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRateLimitFullTable(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{ResponsesPerSecond: 1, IPv4PrefixLength: 32, IPv6PrefixLength: 128})
+	msg := new(dns.Msg)
+	msg.SetQuestion("a.example.org.", dns.TypeA)
+	msg.Answer = append(msg.Answer, mustRR(t, "a.example.org. 300 IN A 192.0.2.1"))
+	client := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+
+	// Client 0 goes over the limit, then the table fills up. The buckets
+	// may refill while it does, so only the entries are checked below.
+	l.check(client(0), msg, "example.org.")
+	if action := l.check(client(0), msg, "example.org."); action != rrlDrop {
+		t.Fatalf("action = %d; want %d", action, rrlDrop)
+	}
+	for i := 1; i < maxRateEntries; i++ {
+		l.check(client(i), msg, "example.org.")
+	}
+	// Client 0 is used again, so client 1 is evicted for the next one
+	l.check(client(0), msg, "example.org.")
+	l.check(client(maxRateEntries), msg, "example.org.")
+	if len(l.entries) != maxRateEntries || l.order.Len() != maxRateEntries {
+		t.Errorf("%d entries; want %d", len(l.entries), maxRateEntries)
+	}
+	tests := []struct {
+		client int
+		kept   bool
+	}{
+		{0, true},
+		{1, false},
+		{2, true},
+		{maxRateEntries - 1, true},
+		{maxRateEntries, true},
+	}
+	for _, tt := range tests {
+		if _, ok := l.entries[l.getRateKey(client(tt.client), msg, "example.org.")]; ok != tt.kept {
+			t.Errorf("entry of %s kept = %v; want %v", client(tt.client), ok, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// serialDatabase wraps a Database and increments the serial number of zone
+// whenever its records actually change, so that secondaries and caches can
+// tell when to refresh. The changes are recorded in journal, if set, for
+// incremental zone transfers.
+type serialDatabase struct {
+	Database
+	zone    string
+	journal *zoneJournal
+	mu      sync.Mutex
+}
+
+func haveValuesChanged(original []string, updated []string) bool {
+	var (
+		originalMap = make(map[string]bool)
+		updatedMap  = make(map[string]bool)
+	)
+
+	for _, val := range original {
+		originalMap[val] = true
+	}
+	for _, val := range updated {
+		updatedMap[val] = true
+	}
+	if len(originalMap) != len(updatedMap) {
+		return true
+	}
+	for val := range updatedMap {
+		if !originalMap[val] {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSerial returns the serial number following serial, using the current
+// Unix time when possible so that the serial also tells when the zone changed
+func nextSerial(serial uint32, now time.Time) uint32 {
+	next := uint32(now.Unix())
+	// Compare in serial number arithmetic (RFC 1982)
+	if int32(next-serial) <= 0 {
+		next = serial + 1
+	}
+	return next
+}
+
+// GetSerial returns the serial number of zone, storing an initial one
+// if the zone has none yet.
+func (db *serialDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	serial, err := db.Database.GetSerial(ctx, zone)
+	if err != nil || serial != 0 {
+		return serial, err
+	}
+	serial = nextSerial(0, time.Now())
+	return serial, db.Database.PutSerial(ctx, zone, serial)
+}
+
+// Callers must hold db.mu.
+func (db *serialDatabase) incrementSerial(ctx context.Context, change zoneChange) error {
+	serial, err := db.Database.GetSerial(ctx, db.zone)
+	if err != nil {
+		return err
+	}
+	change.from = serial
+	change.to = nextSerial(serial, time.Now())
+	if err := db.Database.PutSerial(ctx, db.zone, change.to); err != nil {
+		return err
+	}
+	db.journal.add(change)
+	return nil
+}
+
+func (db *serialDatabase) PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if !haveAddressesChanged(original, addresses) {
+		return nil
+	}
+	if err := db.Database.PutIPAddresses(ctx, domain, addresses); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, oldIPs: original, newIPs: addresses})
+}
+
+func (db *serialDatabase) DeleteIPAddresses(ctx context.Context, domain string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetIPAddresses(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if len(original) == 0 {
+		return nil
+	}
+	if err := db.Database.DeleteIPAddresses(ctx, domain); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, oldIPs: original})
+}
+
+func (db *serialDatabase) PutTXTValues(ctx context.Context, domain string, values []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetTXTValues(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if !haveValuesChanged(original, values) {
+		return nil
+	}
+	if err := db.Database.PutTXTValues(ctx, domain, values); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, oldTXT: original, newTXT: values})
+}
+
+func (db *serialDatabase) DeleteTXTValues(ctx context.Context, domain string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetTXTValues(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if len(original) == 0 {
+		return nil
+	}
+	if err := db.Database.DeleteTXTValues(ctx, domain); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, oldTXT: original})
+}
+
+func (db *serialDatabase) PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetRecords(ctx, domain, rrtype)
+	if err != nil {
+		return err
+	}
+	if !haveValuesChanged(original, values) {
+		return nil
+	}
+	if err := db.Database.PutRecords(ctx, domain, rrtype, values); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, rrtype: rrtype, oldRecords: original, newRecords: values})
+}
+
+func (db *serialDatabase) DeleteRecords(ctx context.Context, domain string, rrtype uint16) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetRecords(ctx, domain, rrtype)
+	if err != nil {
+		return err
+	}
+	if len(original) == 0 {
+		return nil
+	}
+	if err := db.Database.DeleteRecords(ctx, domain, rrtype); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain, rrtype: rrtype, oldRecords: original})
+}
+
+// PutViewAddresses journals the change without records, as the addresses of
+// views are not transferred, only to keep the serial numbers in sequence.
+func (db *serialDatabase) PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetViewAddresses(ctx, domain, view)
+	if err != nil {
+		return err
+	}
+	if !haveAddressesChanged(original, addresses) {
+		return nil
+	}
+	if err := db.Database.PutViewAddresses(ctx, domain, view, addresses); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain})
+}
+
+func (db *serialDatabase) DeleteViewAddresses(ctx context.Context, domain, view string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	original, err := db.Database.GetViewAddresses(ctx, domain, view)
+	if err != nil {
+		return err
+	}
+	if len(original) == 0 {
+		return nil
+	}
+	if err := db.Database.DeleteViewAddresses(ctx, domain, view); err != nil {
+		return err
+	}
+	return db.incrementSerial(ctx, zoneChange{domain: domain})
+}
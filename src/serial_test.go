@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNextSerial(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		serial uint32
+		want   uint32
+	}{
+		{"new zone", 0, 1700000000},
+		{"older", 1600000000, 1700000000},
+		{"same second", 1700000000, 1700000001},
+		{"ahead of the clock", 1700000100, 1700000101},
+		{"wraps around", 0xffffffff, 1700000000},
+	}
+	for _, tt := range tests {
+		if got := nextSerial(tt.serial, now); got != tt.want {
+			t.Errorf("%s: nextSerial(%d) = %d; want %d", tt.name, tt.serial, got, tt.want)
+		}
+	}
+}
+
+func TestSerialDatabase(t *testing.T) {
+	ctx := context.Background()
+	journal := newZoneJournal()
+	db := &serialDatabase{Database: &MemoryDatabase{}, zone: "example.org", journal: journal}
+	ip := []net.IP{net.ParseIP("192.0.2.1")}
+
+	tests := []struct {
+		name    string
+		change  func() error
+		changed bool
+	}{
+		{"put addresses", func() error { return db.PutIPAddresses(ctx, "a.example.org", ip) }, true},
+		{"same addresses", func() error { return db.PutIPAddresses(ctx, "a.example.org", ip) }, false},
+		{"delete addresses", func() error { return db.DeleteIPAddresses(ctx, "a.example.org") }, true},
+		{"delete no addresses", func() error { return db.DeleteIPAddresses(ctx, "a.example.org") }, false},
+		{"put TXT", func() error { return db.PutTXTValues(ctx, "a.example.org", []string{`"v"`}) }, true},
+		{"same TXT", func() error { return db.PutTXTValues(ctx, "a.example.org", []string{`"v"`}) }, false},
+		{"delete TXT", func() error { return db.DeleteTXTValues(ctx, "a.example.org") }, true},
+		{"put MX", func() error {
+			return db.PutRecords(ctx, "example.org", dns.TypeMX, []string{"10 mail.example.org."})
+		}, true},
+		{"same MX", func() error {
+			return db.PutRecords(ctx, "example.org", dns.TypeMX, []string{"10 mail.example.org."})
+		}, false},
+		{"delete MX", func() error { return db.DeleteRecords(ctx, "example.org", dns.TypeMX) }, true},
+		{"put view addresses", func() error { return db.PutViewAddresses(ctx, "a.example.org", "lan", ip) }, true},
+		{"same view addresses", func() error { return db.PutViewAddresses(ctx, "a.example.org", "lan", ip) }, false},
+		{"delete view addresses", func() error { return db.DeleteViewAddresses(ctx, "a.example.org", "lan") }, true},
+		{"delete no view addresses", func() error { return db.DeleteViewAddresses(ctx, "a.example.org", "lan") }, false},
+	}
+
+	serial, err := db.GetSerial(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		before := len(journal.changes)
+		if err := tt.change(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		next, err := db.GetSerial(ctx, "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := next != serial; changed != tt.changed {
+			t.Errorf("%s: serial changed = %v; want %v", tt.name, changed, tt.changed)
+		}
+		if tt.changed {
+			if len(journal.changes) != before+1 {
+				t.Fatalf("%s: %d changes journaled; want 1", tt.name, len(journal.changes)-before)
+			}
+			if change := journal.changes[before]; change.from != serial || change.to != next {
+				t.Errorf("%s: journaled %d to %d; want %d to %d", tt.name, change.from, change.to, serial, next)
+			}
+		}
+		serial = next
+	}
+
+	// The journal has no gaps for IXFR
+	changes, ok := journal.since(journal.changes[0].from)
+	if !ok || len(changes) != len(journal.changes) {
+		t.Fatalf("since = %d changes, %v; want %d", len(changes), ok, len(journal.changes))
+	}
+	for i := 1; i < len(changes); i++ {
+		if changes[i].from != changes[i-1].to {
+			t.Errorf("change %d starts at %d; want %d", i, changes[i].from, changes[i-1].to)
+		}
+	}
+}
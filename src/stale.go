@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// TTL of stale answers and how long answers are kept for serving
+	// them stale, as recommended by RFC 8767
+	staleTTL    = 30
+	staleMaxAge = 24 * time.Hour
+
+	// Bound the memory used by queries for random names
+	maxStaleEntries = 10000
+)
+
+// staleAnswers counts the stale answers served
+var staleAnswers = expvar.NewInt("dnsStaleAnswers")
+
+type staleKey struct {
+	name  string
+	qtype uint16
+}
+
+type staleEntry struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+	extra  []dns.RR
+	stored time.Time
+}
+
+// staleCache keeps the last good answer per name and record type, to be
+// served stale (RFC 8767) when the database fails or times out
+type staleCache struct {
+	sync.Mutex
+	entries map[staleKey]*staleEntry
+}
+
+func getStaleKey(msg *dns.Msg) staleKey {
+	q := msg.Question[0]
+	return staleKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+}
+
+// put stores the answer msg
+func (c *staleCache) put(msg *dns.Msg) {
+	key := getStaleKey(msg)
+	entry := &staleEntry{
+		rcode:  msg.Rcode,
+		answer: append([]dns.RR(nil), msg.Answer...),
+		ns:     append([]dns.RR(nil), msg.Ns...),
+		extra:  append([]dns.RR(nil), msg.Extra...),
+		stored: time.Now(),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[staleKey]*staleEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxStaleEntries {
+		// Evict an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+// get returns a stale answer to req, if there is one recent enough
+func (c *staleCache) get(req *dns.Msg) (*dns.Msg, bool) {
+	c.Lock()
+	entry, ok := c.entries[getStaleKey(req)]
+	c.Unlock()
+	if !ok || time.Since(entry.stored) > staleMaxAge {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, entry.rcode)
+	msg.Authoritative = true
+	msg.Answer = getStaleRecords(entry.answer)
+	msg.Ns = getStaleRecords(entry.ns)
+	msg.Extra = getStaleRecords(entry.extra)
+	staleAnswers.Add(1)
+	return msg, true
+}
+
+func getStaleRecords(records []dns.RR) []dns.RR {
+	var stale []dns.RR
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = staleTTL
+		stale = append(stale, rr)
+	}
+	return stale
+}
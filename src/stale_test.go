@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errTestDatabase = errors.New("database down")
+
+// failingDatabase fails every read of records once down is set
+type failingDatabase struct {
+	Database
+	down bool
+}
+
+func (db *failingDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	if db.down {
+		return false, errTestDatabase
+	}
+	return db.Database.DoesDomainExist(ctx, domain)
+}
+
+func (db *failingDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	if db.down {
+		return nil, errTestDatabase
+	}
+	return db.Database.GetIPAddresses(ctx, domain)
+}
+
+func (db *failingDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	if db.down {
+		return 0, errTestDatabase
+	}
+	return db.Database.GetSerial(ctx, zone)
+}
+
+func TestStaleAnswers(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	db := &failingDatabase{Database: z.db}
+	z.db = db
+	z.serve()
+	if err := db.PutIPAddresses(context.Background(), "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qname string
+		down  bool
+		rcode int
+		stale bool
+		// TTL of the records answered, none if zero
+		answerTTL, nsTTL uint32
+	}{
+		{"answer", "a.example.org.", false, dns.RcodeSuccess, false, 300, 3600},
+		{"nonexistent name", "x.example.org.", false, dns.RcodeNameError, false, 0, 300},
+		{"stale answer", "a.example.org.", true, dns.RcodeSuccess, true, staleTTL, staleTTL},
+		{"stale nonexistent name", "x.example.org.", true, dns.RcodeNameError, true, 0, staleTTL},
+		{"never answered", "b.example.org.", true, dns.RcodeServerFailure, false, 0, 0},
+		{"fresh again", "a.example.org.", false, dns.RcodeSuccess, false, 300, 3600},
+	}
+	for _, tt := range tests {
+		db.down = tt.down
+		stale := staleAnswers.Value()
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		msg := z.exchange(req, testTCPClient)
+		if msg.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s; want %s", tt.name, dns.RcodeToString[msg.Rcode], dns.RcodeToString[tt.rcode])
+			continue
+		}
+		if counted := staleAnswers.Value() - stale; (counted == 1) != tt.stale {
+			t.Errorf("%s: %d stale answers counted", tt.name, counted)
+		}
+		for section, ttl := range map[string]uint32{"answer": tt.answerTTL, "authority": tt.nsTTL} {
+			records := msg.Answer
+			if section == "authority" {
+				records = msg.Ns
+			}
+			if ttl == 0 && len(records) != 0 {
+				t.Errorf("%s: %s = %v; want none", tt.name, section, records)
+			}
+			for _, rr := range records {
+				if rr.Header().Ttl != ttl {
+					t.Errorf("%s: TTL of %v = %d; want %d", tt.name, rr, rr.Header().Ttl, ttl)
+				}
+			}
+		}
+	}
+}
+
+func TestStaleCache(t *testing.T) {
+	answer := func(qname string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		msg.Answer = []dns.RR{mustRR(t, qname+" 300 A 192.0.2.1")}
+		return msg
+	}
+
+	c := &staleCache{}
+	c.put(answer("a.example.org."))
+	if msg, ok := c.get(answer("A.EXAMPLE.ORG.")); !ok || len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != staleTTL {
+		t.Errorf("get = %v, %v; want the answer with TTL %d", msg, ok, staleTTL)
+	}
+	if _, ok := c.get(answer("b.example.org.")); ok {
+		t.Error("got a stale answer for a name never answered")
+	}
+
+	// Answers stored longer ago than staleMaxAge are not served
+	c.entries[staleKey{name: "a.example.org.", qtype: dns.TypeA}].stored = time.Now().Add(-staleMaxAge - time.Minute)
+	if _, ok := c.get(answer("a.example.org.")); ok {
+		t.Error("got a stale answer older than staleMaxAge")
+	}
+
+	// The cache is bounded
+	for i := 0; i < maxStaleEntries+10; i++ {
+		c.put(answer(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String() + ".example.org."))
+	}
+	if len(c.entries) != maxStaleEntries {
+		t.Errorf("%d entries cached; want %d", len(c.entries), maxStaleEntries)
+	}
+}
@@ -12,19 +12,62 @@ type Database interface {
 	PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error
 	DeleteIPAddresses(ctx context.Context, domain string) error
 
+	// Addresses of domain answered to clients in view instead of the above
+	GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error)
+	PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error
+	DeleteViewAddresses(ctx context.Context, domain, view string) error
+
 	GetTXTValues(ctx context.Context, domain string) ([]string, error)
 	PutTXTValues(ctx context.Context, domain string, values []string) error
 	DeleteTXTValues(ctx context.Context, domain string) error
 
+	// Records of the other types in recordTypes, as RDATA in presentation format
+	GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error)
+	PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error
+	DeleteRecords(ctx context.Context, domain string, rrtype uint16) error
+
 	GetCertificate(ctx context.Context, name string) ([]byte, error)
 	PutCertificate(ctx context.Context, name string, data []byte) error
 	DeleteCertificate(ctx context.Context, name string) error
+	ListCertificates(ctx context.Context) ([]string, error)
+
+	// Names with records
+	ListDomains(ctx context.Context) ([]string, error)
+
+	// Serial number of the zone, zero if none has been stored yet
+	GetSerial(ctx context.Context, zone string) (uint32, error)
+	PutSerial(ctx context.Context, zone string, serial uint32) error
 }
 
 type AlleyOopConfig struct {
-	Auth authConfig
-	DNS  dnsConfig
-	DB   dbConfig
+	Server serverConfig
+	Auth   authConfig
+	DNS    dnsConfig
+	DB     dbConfig
+	Cert   certConfig
+	// Zones served in addition to the one in the DNS section
+	Zones []dnsConfig
+	// Views of the hosts for clients in some networks, e.g. the LAN
+	Views     []viewConfig
+	Health    healthConfig
+	RateLimit rateLimitConfig
+	Listen    listenConfig
+}
+
+type serverConfig struct {
+	// Public hostname of the server, used for its own certificate, and
+	// answered with Addresses if within the zone
+	Hostname string
+	// Public IPv4 and IPv6 addresses of the server, also served for the apex
+	Addresses []string
+	// Serve the zones over DNS-over-TLS on the DoT addresses of the Listen
+	// section, and DNS-over-HTTPS at /dns-query of the HTTPS server
+	DNSOverTLS   bool
+	DNSOverHTTPS bool
+	// Networks of the resolvers trusted to tell the address of their clients
+	// with EDNS Client Subnet, for picking the view. The view of other
+	// senders is picked by their own address.
+	TrustedResolvers []string
 }
 
 type authConfig struct {
@@ -37,8 +80,118 @@ type dnsConfig struct {
 	NsAdmin     string
 	NameServers []string
 	RecordTTL   int
+	// SOA timers in seconds, Minimum is the TTL of negative answers
+	Refresh int
+	Retry   int
+	Expire  int
+	Minimum int
+	// Answer names directly below the domain which encode an address in
+	// one of these networks with the address, e.g. 10-6-3-8.<domain>
+	// for 10.6.3.8 in "10.0.0.0/8", or 32 hex digits for IPv6
+	SynthesizeNetworks []string
+	// Sign answers online with DNSSEC
+	DNSSEC bool
+	// Secondary nameservers to NOTIFY of changes, as host or host:port
+	Secondaries []string
+	// TSIG key (HMAC-SHA256, base64 encoded secret) required for zone transfers
+	TSIGName   string
+	TSIGSecret string
+	// TSIG keys allowed to change records with dynamic updates (RFC 2136)
+	UpdateKeys []updateKey
+	// API credentials allowed to change the names in this zone only,
+	// in addition to those in the Auth section
+	Auth authConfig
+	// Networks the API and dynamic update clients changing the names in
+	// this zone must be in, any client if empty
+	AllowedNetworks []string
+}
+
+type updateKey struct {
+	// TSIG key name and base64 encoded secret
+	Name   string
+	Secret string
+	// Names the key may update, "*.example.org" matches any name
+	// below example.org
+	Names []string
+}
+
+type viewConfig struct {
+	// Name used in the API, letters and digits only
+	Name string
+	// Clients in these networks, by source address or EDNS Client Subnet,
+	// get the addresses stored for the view
+	Networks []string
+}
+
+type healthConfig struct {
+	// Seconds between probes of every address, and to wait for a connection
+	Interval int
+	Timeout  int
+	Checks   []healthCheck
+}
+
+type healthCheck struct {
+	// Host whose addresses are probed with TCP connections to Port
+	Name string
+	Port int
+}
+
+type rateLimitConfig struct {
+	// UDP responses per second to a client network, per kind of response
+	// and name, zero for no limit
+	ResponsesPerSecond int
+	// Send every Slip-th response over the limit truncated instead of
+	// dropping it, zero drops them all
+	Slip int
+	// Prefix lengths of the client networks, 24 and 56 if not set
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// Networks of resolvers never limited
+	Exempt []string
+}
+
+type listenConfig struct {
+	// Addresses of the servers as host:port, where host may be empty for
+	// all addresses, or the name of a network interface for its addresses.
+	// DNS is served on both UDP and TCP.
+	HTTP  []string
+	HTTPS []string
+	DNS   []string
+	DoT   []string
+	// Take the sockets from systemd socket activation instead, named
+	// http, https, dns and dot with FileDescriptorName=
+	Systemd bool
+	// Switch to this user, and group if set, once the sockets are bound
+	User  string
+	Group string
 }
 
 type dbConfig struct {
 	Directory string
 }
+
+type certConfig struct {
+	// Stop renewing certificates nobody has fetched for this many days,
+	// zero renews them forever
+	RenewIdleDays int
+	// Let's Encrypt rate limits: certificates per registered domain per week
+	// and new orders per 3 hours, zero disables the respective limit
+	MaxCertificates int
+	MaxOrders       int
+	// Part of MaxCertificates only renewals may use
+	RenewalReserve int
+	// Issuer common name of the preferred alternate chain, e.g. "ISRG Root X1"
+	PreferredChain string
+	// ACME certificate profile to request, e.g. "shortlived"
+	Profile string
+	// What /v1/certificate returns: "fullchain" (default) for the
+	// certificate and its intermediates, "chain" for the intermediates only
+	Output string
+	// Request certificates with the OCSP Must-Staple extension
+	MustStaple bool
+	// Publish CAA records at the zone apex allowing only this CA, e.g.
+	// "letsencrypt.org", to issue certificates, and only to our ACME account
+	CAAIssuer string
+	// Where the CA may report refused requests, e.g. "mailto:security@example.org"
+	CAAIodef string
+}
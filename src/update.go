@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// updateMu serializes dynamic updates, so that their prerequisites still
+// hold when they are applied
+var updateMu sync.Mutex
+
+// isUpdateAllowed reports whether the TSIG key keyname may change the
+// records of domain
+func isUpdateAllowed(keyname string, domain string, config dnsConfig) bool {
+	for _, key := range config.UpdateKeys {
+		if !strings.EqualFold(dns.Fqdn(key.Name), keyname) {
+			continue
+		}
+		for _, pattern := range key.Names {
+			if matchName(getDomain(pattern), domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchName reports whether domain matches pattern, in which a leading "*."
+// matches any name below the rest of the pattern
+func matchName(pattern string, domain string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return domain == pattern
+}
+
+// getTXTValue returns the TXT value in the form stored in the database
+func getTXTValue(rr *dns.TXT) string {
+	return strings.TrimPrefix(rr.String(), rr.Hdr.String())
+}
+
+// getTXTStrings returns the character strings of a stored TXT value
+func getTXTStrings(value string) []string {
+	rr, err := dns.NewRR(". TXT " + value)
+	if err != nil || rr == nil {
+		return nil
+	}
+	return rr.(*dns.TXT).Txt
+}
+
+func isSameTXT(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nameUpdate holds the records of a name while an update is applied
+type nameUpdate struct {
+	ipaddrs    []net.IP
+	txtvals    []string
+	ipChanged  bool
+	txtChanged bool
+	// Records were added, which a name with a CNAME record can't have
+	added bool
+	// Types of the other records to delete
+	deleteTypes []uint16
+}
+
+func (u *nameUpdate) addIP(ip net.IP) {
+	for _, addr := range u.ipaddrs {
+		if addr.Equal(ip) {
+			return
+		}
+	}
+	u.ipaddrs = append(u.ipaddrs, ip)
+	u.ipChanged = true
+	u.added = true
+}
+
+func (u *nameUpdate) deleteIPs(match func(net.IP) bool) {
+	var kept []net.IP
+	for _, addr := range u.ipaddrs {
+		if !match(addr) {
+			kept = append(kept, addr)
+		}
+	}
+	if len(kept) != len(u.ipaddrs) {
+		u.ipaddrs = kept
+		u.ipChanged = true
+	}
+}
+
+func (u *nameUpdate) addTXT(value string) {
+	strs := getTXTStrings(value)
+	for _, val := range u.txtvals {
+		if isSameTXT(getTXTStrings(val), strs) {
+			return
+		}
+	}
+	u.txtvals = append(u.txtvals, value)
+	u.txtChanged = true
+	u.added = true
+}
+
+func (u *nameUpdate) deleteTXTs(match func([]string) bool) {
+	var kept []string
+	for _, val := range u.txtvals {
+		if !match(getTXTStrings(val)) {
+			kept = append(kept, val)
+		}
+	}
+	if len(kept) != len(u.txtvals) {
+		u.txtvals = kept
+		u.txtChanged = true
+	}
+}
+
+// getRRset returns the records of type rrtype at name
+func getRRset(ctx context.Context, db Database, name string, rrtype uint16, soa dns.RR, ns []dns.RR, hosts *hostTable, config dnsConfig) ([]dns.RR, error) {
+	domain := getDomain(name)
+	isApex := domain == getDomain(config.Domain)
+	switch rrtype {
+	case dns.TypeSOA:
+		if isApex {
+			return []dns.RR{soa}, nil
+		}
+	case dns.TypeNS:
+		if isApex {
+			return ns, nil
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		ipaddrs, err := db.GetIPAddresses(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		if hostips, ok := hosts.get(domain); ok {
+			ipaddrs = hostips
+		}
+		if rrtype == dns.TypeA {
+			return getARecords(name, config.RecordTTL, ipaddrs)
+		}
+		return getAAAARecords(name, config.RecordTTL, ipaddrs)
+	case dns.TypeTXT:
+		txtvals, err := db.GetTXTValues(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		return getTXTRecords(name, config.RecordTTL, txtvals)
+	default:
+		if isRecordType(rrtype) {
+			values, err := db.GetRecords(ctx, domain, rrtype)
+			if err != nil {
+				return nil, err
+			}
+			return getRecords(name, config.RecordTTL, rrtype, values)
+		}
+	}
+	return nil, nil
+}
+
+// isSameRRset compares two RRsets, ignoring TTLs and duplicates
+func isSameRRset(a []dns.RR, b []dns.RR) bool {
+	contains := func(rrset []dns.RR, rr dns.RR) bool {
+		for _, r := range rrset {
+			if dns.IsDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasType(types []uint16, rrtype uint16) bool {
+	for _, t := range types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrerequisites returns the rcode for the prerequisite section of an
+// update, see RFC 2136 section 3.2
+func checkPrerequisites(ctx context.Context, db Database, req *dns.Msg, soa dns.RR, ns []dns.RR, hosts *hostTable, config dnsConfig) (int, error) {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var (
+		keys     []rrsetKey
+		expected = make(map[rrsetKey][]dns.RR)
+	)
+
+	for _, rr := range req.Answer {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		if !dns.IsSubDomain(dns.Fqdn(config.Domain), hdr.Name) {
+			return dns.RcodeNotZone, nil
+		}
+		domain := getDomain(hdr.Name)
+
+		switch hdr.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+			types, err := getTypes(ctx, db, domain, hosts, domain == getDomain(config.Domain))
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			exists := len(types) > 0
+			if hdr.Rrtype != dns.TypeANY {
+				exists = hasType(types, hdr.Rrtype)
+			}
+			switch {
+			case hdr.Class == dns.ClassANY && !exists && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeNameError, nil
+			case hdr.Class == dns.ClassANY && !exists:
+				return dns.RcodeNXRrset, nil
+			case hdr.Class == dns.ClassNONE && exists && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeYXDomain, nil
+			case hdr.Class == dns.ClassNONE && exists:
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			// Value dependent, compared once all records of the RRset are known
+			key := rrsetKey{domain, hdr.Rrtype}
+			if _, ok := expected[key]; !ok {
+				keys = append(keys, key)
+			}
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+
+	for _, key := range keys {
+		rrset, err := getRRset(ctx, db, dns.Fqdn(key.name), key.rrtype, soa, ns, hosts, config)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		if !isSameRRset(expected[key], rrset) {
+			return dns.RcodeNXRrset, nil
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// checkUpdates returns the rcode for the update section of an update, see
+// RFC 2136 section 3.4.1. Only A, AAAA and TXT records can be added or
+// deleted one by one, the other RRsets only deleted as a whole, and only at
+// names the TSIG key is allowed to update.
+func checkUpdates(req *dns.Msg, keyname string, hosts *hostTable, config dnsConfig) int {
+	for _, rr := range req.Ns {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(dns.Fqdn(config.Domain), hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Rrtype {
+		case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+			if hdr.Class != dns.ClassANY || hdr.Rrtype != dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		}
+
+		isAddress := hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA
+		switch hdr.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if hdr.Class == dns.ClassNONE && hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			if !isAddress && hdr.Rrtype != dns.TypeTXT {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			isAddress = isAddress || hdr.Rrtype == dns.TypeANY
+		default:
+			return dns.RcodeFormatError
+		}
+
+		domain := getDomain(hdr.Name)
+		if !isUpdateAllowed(keyname, domain, config) {
+			return dns.RcodeRefused
+		}
+		// Addresses of hosts are served from the configuration
+		if _, isHost := hosts.get(domain); isHost && isAddress {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdates applies the update section of an update to the database,
+// see RFC 2136 section 3.4.2. The TTLs of added records are ignored. It
+// returns errHasCNAME, without changing anything, if records would be added
+// at a name with a CNAME record.
+func applyUpdates(ctx context.Context, db Database, req *dns.Msg) error {
+	var (
+		domains []string
+		updates = make(map[string]*nameUpdate)
+	)
+	for _, rr := range req.Ns {
+		hdr := rr.Header()
+		domain := getDomain(hdr.Name)
+		u, ok := updates[domain]
+		if !ok {
+			ipaddrs, err := db.GetIPAddresses(ctx, domain)
+			if err != nil {
+				return err
+			}
+			txtvals, err := db.GetTXTValues(ctx, domain)
+			if err != nil {
+				return err
+			}
+			u = &nameUpdate{ipaddrs: ipaddrs, txtvals: txtvals}
+			updates[domain] = u
+			domains = append(domains, domain)
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			switch rr := rr.(type) {
+			case *dns.A:
+				u.addIP(rr.A)
+			case *dns.AAAA:
+				u.addIP(rr.AAAA)
+			case *dns.TXT:
+				u.addTXT(getTXTValue(rr))
+			}
+		case dns.ClassANY:
+			// Deleting the SOA and NS records of the apex is ignored
+			switch hdr.Rrtype {
+			case dns.TypeANY:
+				u.deleteIPs(func(net.IP) bool { return true })
+				u.deleteTXTs(func([]string) bool { return true })
+				u.deleteTypes = append([]uint16(nil), recordTypes...)
+			case dns.TypeA:
+				u.deleteIPs(isIPv4)
+			case dns.TypeAAAA:
+				u.deleteIPs(func(ip net.IP) bool { return !isIPv4(ip) })
+			case dns.TypeTXT:
+				u.deleteTXTs(func([]string) bool { return true })
+			default:
+				if isRecordType(hdr.Rrtype) && !hasType(u.deleteTypes, hdr.Rrtype) {
+					u.deleteTypes = append(u.deleteTypes, hdr.Rrtype)
+				}
+			}
+		case dns.ClassNONE:
+			switch rr := rr.(type) {
+			case *dns.A:
+				u.deleteIPs(rr.A.Equal)
+			case *dns.AAAA:
+				u.deleteIPs(rr.AAAA.Equal)
+			case *dns.TXT:
+				u.deleteTXTs(func(strs []string) bool { return isSameTXT(strs, rr.Txt) })
+			}
+		}
+	}
+
+	// Refuse the whole update before changing anything, unless the update
+	// deletes the CNAME record too
+	for _, domain := range domains {
+		u := updates[domain]
+		if u.added && !hasType(u.deleteTypes, dns.TypeCNAME) {
+			if err := checkCNAME(ctx, db, domain, dns.TypeA, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, domain := range domains {
+		u := updates[domain]
+		if u.ipChanged {
+			var err error
+			if len(u.ipaddrs) == 0 {
+				err = db.DeleteIPAddresses(ctx, domain)
+			} else {
+				err = db.PutIPAddresses(ctx, domain, u.ipaddrs)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if u.txtChanged {
+			var err error
+			if len(u.txtvals) == 0 {
+				err = db.DeleteTXTValues(ctx, domain)
+			} else {
+				err = db.PutTXTValues(ctx, domain, u.txtvals)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, rrtype := range u.deleteTypes {
+			if err := db.DeleteRecords(ctx, domain, rrtype); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateZone handles a dynamic update (RFC 2136) signed with one of the TSIG
+// keys in config.UpdateKeys and sent from one of config.AllowedNetworks, and
+// returns the rcode of the response
+func updateZone(req *dns.Msg, tsigStatus error, remoteIP net.IP, db Database, domain string, ns []dns.RR, hosts *hostTable, config dnsConfig) (int, error) {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA ||
+		req.Question[0].Qclass != dns.ClassINET {
+		return dns.RcodeFormatError, nil
+	}
+	if !strings.EqualFold(req.Question[0].Name, domain) {
+		return dns.RcodeNotAuth, nil
+	}
+	tsig := req.IsTsig()
+	if tsig == nil {
+		return dns.RcodeRefused, nil
+	}
+	if tsigStatus != nil {
+		return dns.RcodeNotAuth, nil
+	}
+	if !isNetworkAllowed(remoteIP, config) {
+		return dns.RcodeRefused, nil
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	// Use timeout of 10 seconds, like updates through the API
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	soa, err := getCurrentSOA(db, domain, config)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if rcode, err := checkPrerequisites(ctx, db, req, soa, ns, hosts, config); rcode != dns.RcodeSuccess {
+		return rcode, err
+	}
+	if rcode := checkUpdates(req, tsig.Hdr.Name, hosts, config); rcode != dns.RcodeSuccess {
+		return rcode, nil
+	}
+	if err := applyUpdates(ctx, db, req); err == errHasCNAME {
+		return dns.RcodeRefused, nil
+	} else if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpdateZone(t *testing.T) {
+	z := newTestZone(t, dnsConfig{
+		Domain:          "example.org",
+		UpdateKeys:      []updateKey{{Name: "upd", Secret: "c2VjcmV0", Names: []string{"*.example.org"}}},
+		AllowedNetworks: []string{"198.51.100.0/24"},
+	})
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutRecords(ctx, "c.example.org", dns.TypeCNAME, []string{"a.example.org."}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutRecords(ctx, "m.example.org", dns.TypeMX, []string{"10 mail.example.org."}); err != nil {
+		t.Fatal(err)
+	}
+
+	// records returns the records of domain, as "<type> <rdata>"
+	records := func(domain string) string {
+		ipaddrs, _ := z.db.GetIPAddresses(ctx, domain)
+		txtvals, _ := z.db.GetTXTValues(ctx, domain)
+		rrs, _ := getNameRecords(domain, ipaddrs, txtvals, 0)
+		others, _ := getAllRecords(ctx, z.db, domain, 0)
+		var s string
+		for _, rr := range append(rrs, others...) {
+			s += fmt.Sprintf("[%s %s]", dns.TypeToString[rr.Header().Rrtype], rr.String()[len(rr.Header().String()):])
+		}
+		return s
+	}
+
+	outside := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5353}
+	tests := []struct {
+		name       string
+		update     func(msg *dns.Msg)
+		unsigned   bool
+		tsigStatus error
+		remote     net.Addr
+		rcode      int
+		domain     string
+		records    string
+	}{
+		{name: "unsigned", unsigned: true, rcode: dns.RcodeRefused,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")}) },
+			domain: "b.example.org", records: ""},
+		{name: "bad signature", tsigStatus: dns.ErrSig, rcode: dns.RcodeNotAuth,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")}) },
+			domain: "b.example.org", records: ""},
+		{name: "outside the allowed networks", remote: outside, rcode: dns.RcodeRefused,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")}) },
+			domain: "b.example.org", records: ""},
+		{name: "add address", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")}) },
+			domain: "b.example.org", records: "[A 192.0.2.2]"},
+		{name: "add TXT", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, `b.example.org. TXT "v"`)}) },
+			domain: "b.example.org", records: `[A 192.0.2.2][TXT "v"]`},
+		{name: "name not allowed for the key", rcode: dns.RcodeRefused,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, `example.org. TXT "v"`)}) },
+			domain: "example.org", records: ""},
+		{name: "name outside the zone", rcode: dns.RcodeNotZone,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "b.example.com. A 192.0.2.2")}) },
+			domain: "b.example.com", records: ""},
+		{name: "add MX", rcode: dns.RcodeRefused,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "m.example.org. MX 20 mx.example.org.")}) },
+			domain: "m.example.org", records: "[MX 10 mail.example.org.]"},
+		{name: "add address at a CNAME", rcode: dns.RcodeRefused,
+			update: func(msg *dns.Msg) { msg.Insert([]dns.RR{mustRR(t, "c.example.org. A 192.0.2.3")}) },
+			domain: "c.example.org", records: "[CNAME a.example.org.]"},
+		{name: "replace a CNAME with an address", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) {
+				msg.RemoveRRset([]dns.RR{mustRR(t, "c.example.org. CNAME a.example.org.")})
+				msg.Insert([]dns.RR{mustRR(t, "c.example.org. A 192.0.2.3")})
+			},
+			domain: "c.example.org", records: "[A 192.0.2.3]"},
+		{name: "delete MX", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) { msg.RemoveRRset([]dns.RR{mustRR(t, "m.example.org. MX 10 mail.example.org.")}) },
+			domain: "m.example.org", records: ""},
+		{name: "prerequisite name in use", rcode: dns.RcodeNameError,
+			update: func(msg *dns.Msg) {
+				msg.NameUsed([]dns.RR{mustRR(t, "x.example.org. A 192.0.2.4")})
+				msg.Insert([]dns.RR{mustRR(t, "x.example.org. A 192.0.2.4")})
+			},
+			domain: "x.example.org", records: ""},
+		{name: "prerequisite RRset", rcode: dns.RcodeNXRrset,
+			update: func(msg *dns.Msg) {
+				msg.Used([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.9")})
+				msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.4")})
+			},
+			domain: "b.example.org", records: `[A 192.0.2.2][TXT "v"]`},
+		{name: "prerequisite and update", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) {
+				msg.Used([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")})
+				msg.Insert([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.4")})
+			},
+			domain: "b.example.org", records: `[A 192.0.2.2][A 192.0.2.4][TXT "v"]`},
+		{name: "delete one address", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) { msg.Remove([]dns.RR{mustRR(t, "b.example.org. A 192.0.2.2")}) },
+			domain: "b.example.org", records: `[A 192.0.2.4][TXT "v"]`},
+		{name: "delete the name", rcode: dns.RcodeSuccess,
+			update: func(msg *dns.Msg) { msg.RemoveName([]dns.RR{mustRR(t, "b.example.org. ANY")}) },
+			domain: "b.example.org", records: ""},
+	}
+	for _, tt := range tests {
+		msg := new(dns.Msg)
+		msg.SetUpdate("example.org.")
+		tt.update(msg)
+		if !tt.unsigned {
+			msg.SetTsig("upd.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		// As received, with the lengths of the records set
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+
+		remote := tt.remote
+		if remote == nil {
+			remote = testTCPClient
+		}
+		w := &testWriter{remote: remote, tsigStatus: tt.tsigStatus}
+		z.handler(w, req)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: %d responses", tt.name, len(w.msgs))
+		}
+		if rcode := w.msgs[0].Rcode; rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s; want %s", tt.name, dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+		}
+		if got := records(tt.domain); got != tt.records {
+			t.Errorf("%s: records of %s = %s; want %s", tt.name, tt.domain, got, tt.records)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		pattern, domain string
+		match           bool
+	}{
+		{"a.example.org", "a.example.org", true},
+		{"a.example.org", "b.example.org", false},
+		{"*.example.org", "a.example.org", true},
+		{"*.example.org", "a.b.example.org", true},
+		{"*.example.org", "example.org", false},
+		{"*.example.org", "aexample.org", false},
+	}
+	for _, tt := range tests {
+		if match := matchName(tt.pattern, tt.domain); match != tt.match {
+			t.Errorf("matchName(%q, %q) = %v; want %v", tt.pattern, tt.domain, match, tt.match)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+
+	"github.com/miekg/dns"
+)
+
+var viewnameRegexp = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
+type clientView struct {
+	name     string
+	networks []*net.IPNet
+}
+
+// getViews parses the networks of the views, which getConfig has checked
+func getViews(configs []viewConfig) []clientView {
+	var views []clientView
+	for _, config := range configs {
+		view := clientView{name: config.Name}
+		for _, cidr := range config.Networks {
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				view.networks = append(view.networks, network)
+			}
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// getView returns the name of the first view with a network containing ip,
+// or "" if there is none
+func getView(views []clientView, ip net.IP) string {
+	for _, view := range views {
+		for _, network := range view.networks {
+			if network.Contains(ip) {
+				return view.name
+			}
+		}
+	}
+	return ""
+}
+
+// getNetworks parses cidrs, which getConfig has checked
+func getNetworks(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// isTrustedResolver tells whether the EDNS Client Subnet option sent from ip
+// may pick the view
+func isTrustedResolver(ip net.IP, resolvers []*net.IPNet) bool {
+	for _, network := range resolvers {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientSubnet returns the EDNS Client Subnet option of req (RFC 7871),
+// if there is one
+func getClientSubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// getSubnetReply returns the option to answer subnet with. The answer holds
+// for the whole subnet when the server has views, and for any client
+// otherwise.
+func getSubnetReply(subnet *dns.EDNS0_SUBNET, views []clientView) *dns.EDNS0_SUBNET {
+	reply := *subnet
+	reply.SourceScope = 0
+	if len(views) > 0 {
+		reply.SourceScope = subnet.SourceNetmask
+	}
+	return &reply
+}
+
+// viewDatabase wraps a Database and answers the addresses stored for view
+// instead of the others, for names that have them
+type viewDatabase struct {
+	Database
+	view string
+}
+
+func (db *viewDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	addresses, err := db.Database.GetViewAddresses(ctx, domain, db.view)
+	if err != nil || len(addresses) > 0 {
+		return len(addresses) > 0, err
+	}
+	return db.Database.DoesDomainExist(ctx, domain)
+}
+
+func (db *viewDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	addresses, err := db.Database.GetViewAddresses(ctx, domain, db.view)
+	if err != nil || len(addresses) > 0 {
+		return addresses, err
+	}
+	return db.Database.GetIPAddresses(ctx, domain)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetView(t *testing.T) {
+	views := getViews([]viewConfig{
+		{Name: "lan", Networks: []string{"192.168.0.0/16", "fd00::/8"}},
+		{Name: "vpn", Networks: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+	})
+	tests := []struct {
+		ip   string
+		view string
+	}{
+		{"192.168.0.1", "lan"},
+		{"192.168.1.1", "lan"},
+		{"fd00::1", "lan"},
+		{"10.1.2.3", "vpn"},
+		{"203.0.113.1", ""},
+	}
+	for _, tt := range tests {
+		if view := getView(views, net.ParseIP(tt.ip)); view != tt.view {
+			t.Errorf("getView(%s) = %q; want %q", tt.ip, view, tt.view)
+		}
+	}
+	if view := getView(views, nil); view != "" {
+		t.Errorf("getView(nil) = %q; want none", view)
+	}
+}
+
+func TestViewHandler(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org"})
+	ctx := context.Background()
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("203.0.113.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutViewAddresses(ctx, "a.example.org", "lan", []net.IP{net.ParseIP("192.168.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutViewAddresses(ctx, "b.example.org", "lan", []net.IP{net.ParseIP("192.168.0.2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	z.views = getViews([]viewConfig{{Name: "lan", Networks: []string{"192.168.0.0/16"}}})
+	z.resolvers = getNetworks([]string{"198.51.100.0/24", "192.168.0.53/32"})
+	z.serve()
+
+	lan := &net.UDPAddr{IP: net.ParseIP("192.168.0.53"), Port: 5353}
+	untrusted := &net.UDPAddr{IP: net.ParseIP("203.0.113.53"), Port: 5353}
+	untrustedLAN := &net.UDPAddr{IP: net.ParseIP("192.168.0.54"), Port: 5353}
+	tests := []struct {
+		name   string
+		qname  string
+		remote net.Addr
+		// Client subnet sent by the resolver, if any
+		subnet string
+		rcode  int
+		answer string
+		// Scope of the client subnet answered, -1 if none
+		scope int
+	}{
+		{"outside", "a.example.org.", testUDPClient, "", dns.RcodeSuccess, "[203.0.113.1]", -1},
+		{"view", "a.example.org.", lan, "", dns.RcodeSuccess, "[192.168.0.1]", -1},
+		{"view only name outside", "b.example.org.", testUDPClient, "", dns.RcodeNameError, "[]", -1},
+		{"view only name", "b.example.org.", lan, "", dns.RcodeSuccess, "[192.168.0.2]", -1},
+		{"subnet in the view", "a.example.org.", testUDPClient, "192.168.7.0/24", dns.RcodeSuccess, "[192.168.0.1]", 24},
+		{"subnet outside", "a.example.org.", lan, "203.0.113.0/24", dns.RcodeSuccess, "[203.0.113.1]", 24},
+		{"empty subnet", "a.example.org.", lan, "0.0.0.0/0", dns.RcodeSuccess, "[203.0.113.1]", 0},
+		{"subnet in the view from untrusted sender", "a.example.org.", untrusted, "192.168.7.0/24", dns.RcodeSuccess,
+			"[203.0.113.1]", -1},
+		{"subnet outside from untrusted sender in the view", "a.example.org.", untrustedLAN, "203.0.113.0/24",
+			dns.RcodeSuccess, "[192.168.0.1]", -1},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		if tt.subnet != "" {
+			req.SetEdns0(1232, false)
+			ip, network, _ := net.ParseCIDR(tt.subnet)
+			netmask, _ := network.Mask.Size()
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: uint8(netmask),
+				Address:       ip,
+			})
+		}
+		msg := z.exchange(req, tt.remote)
+		if msg.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s; want %s", tt.name, dns.RcodeToString[msg.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var ipaddrs []net.IP
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				ipaddrs = append(ipaddrs, a.A)
+			}
+		}
+		if answer := fmt.Sprint(ipaddrs); answer != tt.answer {
+			t.Errorf("%s: answer = %s; want %s", tt.name, answer, tt.answer)
+		}
+		scope := -1
+		if subnet := getClientSubnet(msg); subnet != nil {
+			scope = int(subnet.SourceScope)
+		}
+		if scope != tt.scope {
+			t.Errorf("%s: subnet scope = %d; want %d", tt.name, scope, tt.scope)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Number of changes kept for IXFR, older serials get a full transfer
+	maxJournalEntries = 1000
+	// Records per message of a zone transfer
+	xfrChunkSize = 100
+	// Wait for more changes before notifying the secondaries
+	notifyDelay = time.Second
+)
+
+// zoneChange is a change to the records of a single name,
+// which took the zone from serial number from to serial number to
+type zoneChange struct {
+	from, to       uint32
+	domain         string
+	oldIPs, newIPs []net.IP
+	oldTXT, newTXT []string
+	// Records of the other types, of type rrtype
+	rrtype                 uint16
+	oldRecords, newRecords []string
+}
+
+// zoneJournal keeps the recent changes to the zone in memory.
+// A nil *zoneJournal records nothing.
+type zoneJournal struct {
+	sync.Mutex
+	changes []zoneChange
+	// changed receives a value after changes, without blocking
+	changed chan struct{}
+}
+
+func newZoneJournal() *zoneJournal {
+	return &zoneJournal{changed: make(chan struct{}, 1)}
+}
+
+func (j *zoneJournal) add(change zoneChange) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	if len(j.changes) >= maxJournalEntries {
+		j.changes = j.changes[1:]
+	}
+	j.changes = append(j.changes, change)
+	j.Unlock()
+
+	select {
+	case j.changed <- struct{}{}:
+	default:
+	}
+}
+
+// since returns the changes after serial, and whether the journal
+// goes back far enough to tell
+func (j *zoneJournal) since(serial uint32) ([]zoneChange, bool) {
+	j.Lock()
+	defer j.Unlock()
+	for i, change := range j.changes {
+		if change.from == serial {
+			return append([]zoneChange(nil), j.changes[i:]...), true
+		}
+	}
+	return nil, false
+}
+
+// getNameRecords returns the A, AAAA and TXT records of domain
+func getNameRecords(domain string, ipaddrs []net.IP, txtvals []string, recordTTL int) ([]dns.RR, error) {
+	fqdn := dns.Fqdn(domain)
+	arecords, err := getARecords(fqdn, recordTTL, ipaddrs)
+	if err != nil {
+		return nil, err
+	}
+	aaaarecords, err := getAAAARecords(fqdn, recordTTL, ipaddrs)
+	if err != nil {
+		return nil, err
+	}
+	txtrecords, err := getTXTRecords(fqdn, recordTTL, txtvals)
+	if err != nil {
+		return nil, err
+	}
+	records := append(arecords, aaaarecords...)
+	return append(records, txtrecords...), nil
+}
+
+// getZoneRecords returns all records of the zone but the SOA
+func getZoneRecords(ctx context.Context, db Database, ns []dns.RR, hosts *hostTable, config dnsConfig) ([]dns.RR, error) {
+	records := append([]dns.RR(nil), ns...)
+	for host, ipaddrs := range hosts.static {
+		hostrecords, err := getNameRecords(host, ipaddrs, nil, config.RecordTTL)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, hostrecords...)
+	}
+
+	domains, err := db.ListDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range domains {
+		if !dns.IsSubDomain(dns.Fqdn(config.Domain), dns.Fqdn(domain)) {
+			continue
+		}
+		var ipaddrs []net.IP
+		if _, isHost := hosts.get(domain); !isHost {
+			ipaddrs, err = db.GetIPAddresses(ctx, domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+		txtvals, err := db.GetTXTValues(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		namerecords, err := getNameRecords(domain, ipaddrs, txtvals, config.RecordTTL)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, namerecords...)
+		otherrecords, err := getAllRecords(ctx, db, domain, config.RecordTTL)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, otherrecords...)
+	}
+	return records, nil
+}
+
+// getJournalRecords returns the IXFR sequence of deletions and additions
+// for changes, each introduced by the SOA record of its serial numbers
+func getJournalRecords(changes []zoneChange, soa *dns.SOA, hosts *hostTable, config dnsConfig) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, change := range changes {
+		// Changes outside the zone, which AXFR leaves out too, keep only
+		// their serial numbers
+		if !dns.IsSubDomain(dns.Fqdn(config.Domain), dns.Fqdn(change.domain)) {
+			change = zoneChange{from: change.from, to: change.to}
+		}
+		// Addresses of hosts are not served from the database
+		if _, isHost := hosts.get(change.domain); isHost {
+			change.oldIPs, change.newIPs = nil, nil
+		}
+		deleted, err := getNameRecords(change.domain, change.oldIPs, change.oldTXT, config.RecordTTL)
+		if err != nil {
+			return nil, err
+		}
+		added, err := getNameRecords(change.domain, change.newIPs, change.newTXT, config.RecordTTL)
+		if err != nil {
+			return nil, err
+		}
+		if change.rrtype != 0 {
+			fqdn := dns.Fqdn(change.domain)
+			if deleted, err = getRecords(fqdn, config.RecordTTL, change.rrtype, change.oldRecords); err != nil {
+				return nil, err
+			}
+			if added, err = getRecords(fqdn, config.RecordTTL, change.rrtype, change.newRecords); err != nil {
+				return nil, err
+			}
+		}
+
+		from := dns.Copy(soa).(*dns.SOA)
+		from.Serial = change.from
+		to := dns.Copy(soa).(*dns.SOA)
+		to.Serial = change.to
+		records = append(records, from)
+		records = append(records, deleted...)
+		records = append(records, to)
+		records = append(records, added...)
+	}
+	return records, nil
+}
+
+// transferZone answers AXFR and IXFR requests of secondaries, which have to
+// authenticate with TSIG
+func transferZone(w dns.ResponseWriter, req *dns.Msg, db Database, journal *zoneJournal, soa *dns.SOA, ns []dns.RR, hosts *hostTable, config dnsConfig) error {
+	q := req.Question[0]
+	// Transfers may take more than one message, which only a stream can
+	// carry (RFC 5936 section 4.2), unlike UDP and DNS-over-HTTPS
+	_, isUDP := w.RemoteAddr().(*net.UDPAddr)
+	_, isDoH := w.(*dohWriter)
+	singleMsg := isUDP || isDoH
+	if q.Qtype == dns.TypeAXFR && singleMsg {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		return w.WriteMsg(msg)
+	}
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil || !strings.EqualFold(tsig.Hdr.Name, dns.Fqdn(config.TSIGName)) {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeNotAuth)
+		return w.WriteMsg(msg)
+	}
+
+	var (
+		records []dns.RR
+		err     error
+		done    bool
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if q.Qtype == dns.TypeIXFR {
+		var serial uint32
+		for _, rr := range req.Ns {
+			if clientsoa, ok := rr.(*dns.SOA); ok {
+				serial = clientsoa.Serial
+			}
+		}
+		if serial == soa.Serial || singleMsg {
+			// Up to date, or the secondary should retry over TCP
+			records, done = []dns.RR{soa}, true
+		} else if changes, ok := journal.since(serial); ok {
+			records, err = getJournalRecords(changes, soa, hosts, config)
+			if err != nil {
+				return err
+			}
+			records = append([]dns.RR{soa}, records...)
+			records, done = append(records, soa), true
+		}
+		// Otherwise fall back to a full transfer
+	}
+	if !done {
+		records, err = getZoneRecords(ctx, db, ns, hosts, config)
+		if err != nil {
+			return err
+		}
+		records = append([]dns.RR{soa}, records...)
+		records = append(records, soa)
+	}
+
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(records) > 0 {
+			n := xfrChunkSize
+			if n > len(records) {
+				n = len(records)
+			}
+			ch <- &dns.Envelope{RR: records[:n]}
+			records = records[n:]
+		}
+	}()
+	tr := new(dns.Transfer)
+	err = tr.Out(w, req, ch)
+	// Drain the channel so that the goroutine ends if writing failed
+	for range ch {
+	}
+	return err
+}
+
+// sendNotify tells the secondaries that the zone has changed, whenever
+// the journal records a change. It never returns.
+func sendNotify(journal *zoneJournal, getSOA func() (*dns.SOA, error), config dnsConfig) {
+	for range journal.changed {
+		// Coalesce changes arriving in quick succession
+		time.Sleep(notifyDelay)
+		soa, err := getSOA()
+		if err != nil {
+			fmt.Printf("NOTIFY failed with error: %v\n", err)
+			continue
+		}
+
+		client := new(dns.Client)
+		if config.TSIGName != "" {
+			client.TsigSecret = map[string]string{dns.Fqdn(config.TSIGName): config.TSIGSecret}
+		}
+		for _, secondary := range config.Secondaries {
+			if _, _, err := net.SplitHostPort(secondary); err != nil {
+				secondary = net.JoinHostPort(secondary, "53")
+			}
+			msg := new(dns.Msg)
+			msg.SetNotify(soa.Hdr.Name)
+			msg.Answer = []dns.RR{soa}
+			if config.TSIGName != "" {
+				msg.SetTsig(dns.Fqdn(config.TSIGName), dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			if _, _, err := client.Exchange(msg, secondary); err != nil {
+				fmt.Printf("NOTIFY to %s failed with error: %v\n", secondary, err)
+			}
+		}
+	}
+}
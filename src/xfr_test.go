@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTransferZone(t *testing.T) {
+	z := newTestZone(t, dnsConfig{Domain: "example.org", TSIGName: "xfr", TSIGSecret: "c2VjcmV0"})
+	ctx := context.Background()
+	s0, err := z.db.GetSerial(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutIPAddresses(ctx, "a.example.org", []net.IP{net.ParseIP("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	// Names outside the zone are left out of transfers
+	if err := z.db.PutIPAddresses(ctx, "x.example.com", []net.IP{net.ParseIP("192.0.2.2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.db.PutTXTValues(ctx, "a.example.org", []string{`"v"`}); err != nil {
+		t.Fatal(err)
+	}
+	if len(z.journal.changes) != 3 {
+		t.Fatalf("%d changes journaled; want 3", len(z.journal.changes))
+	}
+	s1, s2, s3 := z.journal.changes[0].to, z.journal.changes[1].to, z.journal.changes[2].to
+
+	soa := func(serial uint32) string { return fmt.Sprintf("SOA %d", serial) }
+	tests := []struct {
+		name       string
+		qtype      uint16
+		serial     uint32 // of the secondary, for IXFR
+		remote     net.Addr
+		tsigName   string
+		tsigStatus error
+		rcode      int
+		// Types of the records transferred, SOA records with their serial
+		records []string
+	}{
+		{name: "unsigned", qtype: dns.TypeAXFR, remote: testTCPClient, rcode: dns.RcodeNotAuth},
+		{name: "other key", qtype: dns.TypeAXFR, remote: testTCPClient, tsigName: "other.", rcode: dns.RcodeNotAuth},
+		{name: "bad signature", qtype: dns.TypeAXFR, remote: testTCPClient, tsigName: "xfr.", tsigStatus: dns.ErrSig,
+			rcode: dns.RcodeNotAuth},
+		{name: "AXFR over UDP", qtype: dns.TypeAXFR, remote: testUDPClient, tsigName: "xfr.", rcode: dns.RcodeRefused},
+		{name: "AXFR", qtype: dns.TypeAXFR, remote: testTCPClient, tsigName: "xfr.",
+			records: []string{soa(s3), "NS", "A", "TXT", soa(s3)}},
+		{name: "IXFR up to date", qtype: dns.TypeIXFR, serial: s3, remote: testTCPClient, tsigName: "xfr.",
+			records: []string{soa(s3)}},
+		{name: "IXFR", qtype: dns.TypeIXFR, serial: s0, remote: testTCPClient, tsigName: "xfr.",
+			records: []string{soa(s3), soa(s0), soa(s1), "A", soa(s1), soa(s2), soa(s2), soa(s3), "TXT", soa(s3)}},
+		{name: "IXFR over UDP", qtype: dns.TypeIXFR, serial: s0, remote: testUDPClient, tsigName: "xfr.",
+			records: []string{soa(s3)}},
+		{name: "IXFR beyond the journal", qtype: dns.TypeIXFR, serial: s0 - 1, remote: testTCPClient, tsigName: "xfr.",
+			records: []string{soa(s3), "NS", "A", "TXT", soa(s3)}},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", tt.qtype)
+		if tt.qtype == dns.TypeIXFR {
+			req.Ns = []dns.RR{&dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+				Serial: tt.serial,
+			}}
+		}
+		if tt.tsigName != "" {
+			req.SetTsig(tt.tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &testWriter{remote: tt.remote, tsigStatus: tt.tsigStatus}
+		z.handler(w, req)
+
+		if len(w.msgs) == 0 {
+			t.Errorf("%s: no response", tt.name)
+			continue
+		}
+		if rcode := w.msgs[0].Rcode; rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s; want %s", tt.name, dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+			continue
+		}
+		var records []string
+		for _, msg := range w.msgs {
+			for _, rr := range msg.Answer {
+				if soa, ok := rr.(*dns.SOA); ok {
+					records = append(records, fmt.Sprintf("SOA %d", soa.Serial))
+				} else {
+					records = append(records, dns.TypeToString[rr.Header().Rrtype])
+				}
+				if !dns.IsSubDomain("example.org.", rr.Header().Name) {
+					t.Errorf("%s: record outside the zone: %v", tt.name, rr)
+				}
+			}
+		}
+		if len(records) != len(tt.records) {
+			t.Errorf("%s: records = %v; want %v", tt.name, records, tt.records)
+			continue
+		}
+		for i := range records {
+			if records[i] != tt.records[i] {
+				t.Errorf("%s: records = %v; want %v", tt.name, records, tt.records)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var errNotInZone = errors.New("name is not in a zone")
+
+// getZone returns the longest of the zones that domain is in, as told
+// by isZone
+func getZone(domain string, isZone func(zone string) bool) (string, bool) {
+	for name := domain; ; {
+		if isZone(name) {
+			return name, true
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			return "", false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// getZones returns the configuration of every zone served, the one in
+// the [dns] section first
+func getZones(config AlleyOopConfig) []dnsConfig {
+	return append([]dnsConfig{config.DNS}, config.Zones...)
+}
+
+// getZoneConfig returns the configuration of the zone domain is in
+func getZoneConfig(domain string, zones []dnsConfig) (dnsConfig, bool) {
+	name, ok := getZone(domain, func(zone string) bool {
+		return isZoneApex(zone, zones)
+	})
+	if !ok {
+		return dnsConfig{}, false
+	}
+	for _, zone := range zones {
+		if getDomain(zone.Domain) == name {
+			return zone, true
+		}
+	}
+	return dnsConfig{}, false
+}
+
+// getSharedKeyName returns the name of a TSIG key configured in two zones, or
+// twice with different secrets. The DNS server knows a single secret for each
+// key name, whichever zone a request is for, so such keys are ambiguous.
+func getSharedKeyName(zones []dnsConfig) (string, bool) {
+	type key struct {
+		zone   string
+		secret string
+	}
+	keys := make(map[string]key)
+	check := func(zone, name, secret string) bool {
+		name = strings.ToLower(dns.Fqdn(name))
+		if other, ok := keys[name]; ok && (other.zone != zone || other.secret != secret) {
+			return false
+		}
+		keys[name] = key{zone, secret}
+		return true
+	}
+	for _, zone := range zones {
+		if zone.TSIGName != "" && !check(zone.Domain, zone.TSIGName, zone.TSIGSecret) {
+			return zone.TSIGName, true
+		}
+		for _, updateKey := range zone.UpdateKeys {
+			if !check(zone.Domain, updateKey.Name, updateKey.Secret) {
+				return updateKey.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isNetworkAllowed tells whether a client at ip may change the names in the
+// zone of config
+func isNetworkAllowed(ip net.IP, config dnsConfig) bool {
+	if len(config.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, cidr := range config.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsZone is a zone served by the DNS server, with its own database and
+// journal of changes
+type dnsZone struct {
+	config  dnsConfig
+	db      Database
+	journal *zoneJournal
+}
+
+// zonedDatabase routes the records of each name to the database of the zone
+// it is in, by longest suffix match, so that every zone keeps its own serial
+// number and cache. Certificates go to the embedded Database, the one of the
+// first zone, and so do reads of names outside all zones, which have no
+// records. Writes of those fail with errNotInZone.
+type zonedDatabase struct {
+	Database
+	zones map[string]Database
+}
+
+func (db *zonedDatabase) getDatabase(domain string) Database {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return db.Database
+	}
+	return zonedb
+}
+
+func (db *zonedDatabase) getZoneDatabase(domain string) (Database, bool) {
+	zone, ok := getZone(domain, func(zone string) bool {
+		_, ok := db.zones[zone]
+		return ok
+	})
+	return db.zones[zone], ok
+}
+
+func (db *zonedDatabase) DoesDomainExist(ctx context.Context, domain string) (bool, error) {
+	return db.getDatabase(domain).DoesDomainExist(ctx, domain)
+}
+
+func (db *zonedDatabase) GetIPAddresses(ctx context.Context, domain string) ([]net.IP, error) {
+	return db.getDatabase(domain).GetIPAddresses(ctx, domain)
+}
+
+func (db *zonedDatabase) PutIPAddresses(ctx context.Context, domain string, addresses []net.IP) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.PutIPAddresses(ctx, domain, addresses)
+}
+
+func (db *zonedDatabase) DeleteIPAddresses(ctx context.Context, domain string) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.DeleteIPAddresses(ctx, domain)
+}
+
+func (db *zonedDatabase) GetViewAddresses(ctx context.Context, domain, view string) ([]net.IP, error) {
+	return db.getDatabase(domain).GetViewAddresses(ctx, domain, view)
+}
+
+func (db *zonedDatabase) PutViewAddresses(ctx context.Context, domain, view string, addresses []net.IP) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.PutViewAddresses(ctx, domain, view, addresses)
+}
+
+func (db *zonedDatabase) DeleteViewAddresses(ctx context.Context, domain, view string) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.DeleteViewAddresses(ctx, domain, view)
+}
+
+func (db *zonedDatabase) GetTXTValues(ctx context.Context, domain string) ([]string, error) {
+	return db.getDatabase(domain).GetTXTValues(ctx, domain)
+}
+
+func (db *zonedDatabase) PutTXTValues(ctx context.Context, domain string, values []string) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.PutTXTValues(ctx, domain, values)
+}
+
+func (db *zonedDatabase) DeleteTXTValues(ctx context.Context, domain string) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.DeleteTXTValues(ctx, domain)
+}
+
+func (db *zonedDatabase) GetRecords(ctx context.Context, domain string, rrtype uint16) ([]string, error) {
+	return db.getDatabase(domain).GetRecords(ctx, domain, rrtype)
+}
+
+func (db *zonedDatabase) PutRecords(ctx context.Context, domain string, rrtype uint16, values []string) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.PutRecords(ctx, domain, rrtype, values)
+}
+
+func (db *zonedDatabase) DeleteRecords(ctx context.Context, domain string, rrtype uint16) error {
+	zonedb, ok := db.getZoneDatabase(domain)
+	if !ok {
+		return errNotInZone
+	}
+	return zonedb.DeleteRecords(ctx, domain, rrtype)
+}
+
+func (db *zonedDatabase) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	return db.getDatabase(zone).GetSerial(ctx, zone)
+}
+
+func (db *zonedDatabase) PutSerial(ctx context.Context, zone string, serial uint32) error {
+	return db.getDatabase(zone).PutSerial(ctx, zone, serial)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var testZones = []dnsConfig{
+	{Domain: "example.org"},
+	{Domain: "lab.example.org", AllowedNetworks: []string{"198.51.100.0/24", "2001:db8::/32"}},
+}
+
+func TestGetZoneConfig(t *testing.T) {
+	tests := []struct {
+		domain string
+		zone   string
+	}{
+		{"example.org", "example.org"},
+		{"a.example.org", "example.org"},
+		{"lab.example.org", "lab.example.org"},
+		{"a.b.lab.example.org", "lab.example.org"},
+		{"alab.example.org", "example.org"},
+		{"example.com", ""},
+		{"org", ""},
+	}
+	for _, tt := range tests {
+		zone, ok := getZoneConfig(tt.domain, testZones)
+		if ok != (tt.zone != "") || zone.Domain != tt.zone {
+			t.Errorf("getZoneConfig(%q) = %q, %v; want %q", tt.domain, zone.Domain, ok, tt.zone)
+		}
+	}
+}
+
+func TestGetSharedKeyName(t *testing.T) {
+	transfer := dnsConfig{Domain: "example.org", TSIGName: "xfr", TSIGSecret: "c2VjcmV0"}
+	update := dnsConfig{Domain: "example.org", TSIGName: "xfr", TSIGSecret: "c2VjcmV0",
+		UpdateKeys: []updateKey{{Name: "certbot", Secret: "Y2VydGJvdA=="}}}
+	tests := []struct {
+		name   string
+		zones  []dnsConfig
+		shared string
+	}{
+		{"distinct keys", []dnsConfig{update,
+			{Domain: "example.com", UpdateKeys: []updateKey{{Name: "other", Secret: "b3RoZXI="}}}}, ""},
+		{"transfer key for updates", []dnsConfig{{Domain: "example.org", TSIGName: "xfr", TSIGSecret: "c2VjcmV0",
+			UpdateKeys: []updateKey{{Name: "xfr.", Secret: "c2VjcmV0"}}}}, ""},
+		{"two secrets in a zone", []dnsConfig{{Domain: "example.org", TSIGName: "xfr", TSIGSecret: "c2VjcmV0",
+			UpdateKeys: []updateKey{{Name: "xfr", Secret: "b3RoZXI="}}}}, "xfr"},
+		{"transfer key in two zones", []dnsConfig{transfer,
+			{Domain: "example.com", TSIGName: "XFR.", TSIGSecret: "c2VjcmV0"}}, "XFR."},
+		{"update key in two zones", []dnsConfig{update,
+			{Domain: "example.com", UpdateKeys: []updateKey{{Name: "certbot", Secret: "Y2VydGJvdA=="}}}}, "certbot"},
+	}
+	for _, tt := range tests {
+		shared, ok := getSharedKeyName(tt.zones)
+		if ok != (tt.shared != "") || shared != tt.shared {
+			t.Errorf("%s: getSharedKeyName = %q, %v; want %q", tt.name, shared, ok, tt.shared)
+		}
+	}
+}
+
+func TestIsNetworkAllowed(t *testing.T) {
+	tests := []struct {
+		ip      string
+		zone    int
+		allowed bool
+	}{
+		{"203.0.113.1", 0, true},
+		{"198.51.100.1", 1, true},
+		{"2001:db8::1", 1, true},
+		{"203.0.113.1", 1, false},
+		{"2001:db9::1", 1, false},
+	}
+	for _, tt := range tests {
+		config := testZones[tt.zone]
+		if allowed := isNetworkAllowed(net.ParseIP(tt.ip), config); allowed != tt.allowed {
+			t.Errorf("isNetworkAllowed(%s, %s) = %v; want %v", tt.ip, config.Domain, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestZonedDatabase(t *testing.T) {
+	ctx := context.Background()
+	root, lab := &MemoryDatabase{}, &MemoryDatabase{}
+	db := &zonedDatabase{Database: root, zones: map[string]Database{"example.org": root, "lab.example.org": lab}}
+	ip := []net.IP{net.ParseIP("192.0.2.1")}
+
+	tests := []struct {
+		domain string
+		// Database the addresses go to, nil if refused
+		zonedb Database
+	}{
+		{"a.example.org", root},
+		{"lab.example.org", lab},
+		{"a.lab.example.org", lab},
+		{"example.com", nil},
+	}
+	for _, tt := range tests {
+		err := db.PutIPAddresses(ctx, tt.domain, ip)
+		if tt.zonedb == nil {
+			if err != errNotInZone {
+				t.Errorf("PutIPAddresses(%q) = %v; want %v", tt.domain, err, errNotInZone)
+			}
+			if ipaddrs, _ := db.GetIPAddresses(ctx, tt.domain); len(ipaddrs) != 0 {
+				t.Errorf("GetIPAddresses(%q) = %v; want none", tt.domain, ipaddrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("PutIPAddresses(%q) = %v", tt.domain, err)
+			continue
+		}
+		for _, zonedb := range []Database{root, lab} {
+			ipaddrs, _ := zonedb.GetIPAddresses(ctx, tt.domain)
+			if stored := len(ipaddrs) != 0; stored != (zonedb == tt.zonedb) {
+				t.Errorf("%s: stored in the wrong zone", tt.domain)
+			}
+		}
+		if ipaddrs, _ := db.GetIPAddresses(ctx, tt.domain); fmt.Sprint(ipaddrs) != fmt.Sprint(ip) {
+			t.Errorf("GetIPAddresses(%q) = %v; want %v", tt.domain, ipaddrs, ip)
+		}
+	}
+}
+
+func TestZoneNetworks(t *testing.T) {
+	h := ZoneNetworks(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {}, testZones)
+	tests := []struct {
+		remote   string
+		hostname string
+		code     int
+	}{
+		{"203.0.113.1:1234", "a.example.org", http.StatusOK},
+		{"198.51.100.1:1234", "a.lab.example.org", http.StatusOK},
+		{"[2001:db8::1]:1234", "a.lab.example.org", http.StatusOK},
+		{"203.0.113.1:1234", "a.lab.example.org", http.StatusForbidden},
+		{"203.0.113.1:1234", "a.example.org,a.lab.example.org", http.StatusForbidden},
+		{"203.0.113.1:1234", "example.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v1/update?hostname="+tt.hostname, nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s from %s: status = %d; want %d", tt.hostname, tt.remote, w.Code, tt.code)
+		}
+	}
+}